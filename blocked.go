@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+/*
+阻塞命令 BLPOP/BRPOP/BLMOVE/BLMPOP/BZPOPMIN/BZPOPMAX/BZMPOP
+1. key都是空的时候，把客户端挂在这些key上，server.blockingKeys 里按先来后到排队
+2. 有超时的话，注册一个一次性的时间事件，到点了回复空并解除阻塞
+3. push之类的命令往key里写了数据，就把key标记为ready
+4. 命令执行完之后，处理ready的key，按顺序服务阻塞在上面的客户端
+*/
+
+const (
+	BLOCKED_NONE int = 0
+	BLOCKED_LIST int = 1
+	BLOCKED_ZSET int = 2
+)
+
+type blockingState struct {
+	btype     int     // 阻塞在什么类型上
+	keys      []*Gobj // 阻塞在哪些key上
+	timeout   int64   // 超时的时间点(ms)，0表示一直等
+	timeoutId int     // 超时时间事件的id
+	where     int     // 从哪边弹出，list是LIST_HEAD/LIST_TAIL，zset是ZSET_MIN/ZSET_MAX
+	count     int64   // BLMPOP/BZMPOP 最多弹出几个，-1表示不是mpop
+	target    *Gobj   // BLMOVE 的目标key
+	whereto   int     // BLMOVE 往目标的哪边放
+}
+
+/*
+解析超时时间，单位是秒，可以是小数
+返回超时的时间点，0表示永不超时
+*/
+func getTimeoutFromObjectOrReply(c *GodisClient, o *Gobj) (int64, bool) {
+	secs, err := strconv.ParseFloat(o.StrVal(), 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		c.AddReplyError("timeout is not a float or out of range")
+		return 0, false
+	}
+	if secs < 0 {
+		c.AddReplyError("timeout is negative")
+		return 0, false
+	}
+	if secs == 0 {
+		return 0, true
+	}
+	ms := int64(secs * 1000)
+	if ms <= 0 {
+		ms = 1
+	}
+	return GetMsTime() + ms, true
+}
+
+/*
+把客户端阻塞在keys上
+调用前要先设置好 c.bpop 里除了keys以外的字段
+*/
+func blockForKeys(c *GodisClient, btype int, keys []*Gobj, timeout int64) {
+	c.bpop.btype = btype
+	c.bpop.timeout = timeout
+	for _, key := range keys {
+		keyStr := key.StrVal()
+		dup := false
+		for _, k := range c.bpop.keys {
+			if k.StrVal() == keyStr {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		key.IncrRefCount()
+		c.bpop.keys = append(c.bpop.keys, key)
+		server.blockingKeys[keyStr] = append(server.blockingKeys[keyStr], c)
+	}
+	if timeout > 0 {
+		interval := timeout - GetMsTime()
+		if interval <= 0 {
+			interval = 1
+		}
+		c.bpop.timeoutId = server.keLoop.AddTimeEvent(KE_ONCE, interval, blockedClientTimeoutProc, c)
+	}
+	c.flags |= CLIENT_BLOCKED
+}
+
+/*
+解除阻塞
+1. 从每个key的等待队列里删掉
+2. 删掉超时事件
+3. 放到unblockedClients里，等beforeSleep的时候处理它积攒的命令
+*/
+func unblockClient(c *GodisClient) {
+	for _, key := range c.bpop.keys {
+		keyStr := key.StrVal()
+		clients := server.blockingKeys[keyStr]
+		for i, bc := range clients {
+			if bc == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(server.blockingKeys, keyStr)
+		} else {
+			server.blockingKeys[keyStr] = clients
+		}
+		key.DecrRefCount()
+	}
+	if c.bpop.target != nil {
+		c.bpop.target.DecrRefCount()
+	}
+	if c.bpop.timeoutId != 0 {
+		server.keLoop.RemoveTimeEvent(c.bpop.timeoutId)
+	}
+	c.bpop = blockingState{}
+	c.flags &^= CLIENT_BLOCKED
+	server.unblockedClients = append(server.unblockedClients, c)
+}
+
+/*
+超时了，回复空数组
+*/
+func blockedClientTimeoutProc(loop *KeLoop, id int, extra interface{}) {
+	c := extra.(*GodisClient)
+	if c.flags&CLIENT_BLOCKED == 0 || c.bpop.timeoutId != id {
+		return
+	}
+	c.AddReplyNullArray()
+	c.bpop.timeoutId = 0 // 事件循环会自己删掉一次性事件
+	unblockClient(c)
+}
+
+/*
+key里有新数据了，如果有客户端阻塞在上面，就标记为ready
+*/
+func signalKeyAsReady(key *Gobj) {
+	keyStr := key.StrVal()
+	if _, ok := server.blockingKeys[keyStr]; !ok {
+		return
+	}
+	if _, ok := server.readyKeysSet[keyStr]; ok {
+		return
+	}
+	server.readyKeysSet[keyStr] = struct{}{}
+	key.IncrRefCount()
+	server.readyKeys = append(server.readyKeys, key)
+}
+
+/*
+服务阻塞在ready key上的客户端
+1. 按阻塞的先后顺序一个个服务，key里没数据了就停
+2. 服务的过程中可能又有key变成ready(BLMOVE往目标里放了数据)，所以要循环到没有ready key为止
+*/
+func handleClientsBlockedOnKeys() {
+	for len(server.readyKeys) > 0 {
+		keys := server.readyKeys
+		server.readyKeys = nil
+		server.readyKeysSet = make(map[string]struct{})
+		for _, key := range keys {
+			clients := append([]*GodisClient(nil), server.blockingKeys[key.StrVal()]...)
+			for _, c := range clients {
+				if c.flags&CLIENT_BLOCKED == 0 {
+					continue
+				}
+				val := findKeyWrite(key)
+				if val == nil {
+					break
+				}
+				prev := server.currentClient
+				server.currentClient = c
+				if c.bpop.btype == BLOCKED_LIST && val.Type == GLIST {
+					serveClientBlockedOnList(c, key, val)
+				} else if c.bpop.btype == BLOCKED_ZSET && val.Type == GZSET {
+					serveClientBlockedOnZset(c, key, val)
+				}
+				server.currentClient = prev
+			}
+			key.DecrRefCount()
+		}
+	}
+}
+
+/*
+处理解除阻塞的客户端在阻塞期间收到的命令
+客户端可能已经断开了，也可能又被阻塞了
+*/
+func processUnblockedClients() {
+	for len(server.unblockedClients) > 0 {
+		c := server.unblockedClients[0]
+		server.unblockedClients = server.unblockedClients[1:]
+		if server.clients[c.fd] != c || c.flags&CLIENT_BLOCKED != 0 || c.qbPos == c.queryLen {
+			continue
+		}
+		if err := ProcessQueryBuf(c); err != nil {
+			setProtocolError(c, err)
+		}
+	}
+}
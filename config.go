@@ -7,7 +7,32 @@ import (
 )
 
 type Config struct {
-	Port int `json:"port"`
+	Port                 int    `json:"port"`
+	NotifyKeyspaceEvents string `json:"notify-keyspace-events"`
+	LuaTimeLimit         int64  `json:"lua-time-limit"`
+	Maxmemory            int64  `json:"maxmemory"`
+	MaxmemoryPolicy      string `json:"maxmemory-policy"`
+	MaxmemorySamples     int    `json:"maxmemory-samples"`
+	LfuLogFactor         int    `json:"lfu-log-factor"`
+	LfuDecayTime         int    `json:"lfu-decay-time"`
+	ActiveRehashing      bool   `json:"activerehashing"`
+	HashSeed             string `json:"hash-seed"` // 32个十六进制字符，为空时每次启动随机生成
+	Requirepass          string `json:"requirepass"`
+
+	Bind         []string `json:"bind"` // 监听的地址，前面加 - 的绑不上也没关系
+	TcpBacklog   int      `json:"tcp-backlog"`
+	TcpKeepalive int      `json:"tcp-keepalive"` // 秒，0表示不开启
+
+	Unixsocket     string `json:"unixsocket"`
+	Unixsocketperm string `json:"unixsocketperm"` // 八进制，比如 "700"
+
+	ProtoMaxBulkLen        int64 `json:"proto-max-bulk-len"`
+	ClientQueryBufferLimit int64 `json:"client-query-buffer-limit"`
+
+	ListMaxListpackSize    int `json:"list-max-listpack-size"`
+	ListCompressDepth      int `json:"list-compress-depth"`
+	ZsetMaxListpackEntries int `json:"zset-max-listpack-entries"`
+	ZsetMaxListpackValue   int `json:"zset-max-listpack-value"`
 }
 
 func LoadConfig(path string) (config *Config, err error) {
@@ -30,7 +55,25 @@ func LoadConfig(path string) (config *Config, err error) {
 		return
 	}
 
-	config = &Config{}
+	config = &Config{
+		LuaTimeLimit:     5000,
+		MaxmemoryPolicy:  "noeviction",
+		MaxmemorySamples: 5,
+		LfuLogFactor:     10,
+		LfuDecayTime:     1,
+		ActiveRehashing:  true,
+
+		Bind:         []string{"*", "-::*"},
+		TcpBacklog:   511,
+		TcpKeepalive: 300,
+
+		ProtoMaxBulkLen:        512 * 1024 * 1024,
+		ClientQueryBufferLimit: 1024 * 1024 * 1024,
+
+		ListMaxListpackSize:    -2,
+		ZsetMaxListpackEntries: 128,
+		ZsetMaxListpackValue:   64,
+	}
 	if err = json.Unmarshal(jsonBytes, config); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"go-redis/dict"
+	"strings"
+)
+
+/*
+DEBUG 命令，给开发和测试用的
+*/
+
+func debugCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "help" && len(c.args) == 2:
+		help := []string{
+			"DEBUG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"HTSTATS <dbid> [full]",
+			"    Return hash table statistics of the specified Redis database.",
+			"DICT-RESIZING <0|1>",
+			"    Enable or disable the main dict and expire dict resizing.",
+			"HELP",
+			"    Print this help.",
+		}
+		c.AddReplyHelp(help)
+	case sub == "htstats" && (len(c.args) == 3 || len(c.args) == 4):
+		dbid, ok := getLongFromObjectOrReply(c, c.args[2], "")
+		if !ok {
+			return
+		}
+		if dbid != 0 {
+			c.AddReplyError("Out of range database")
+			return
+		}
+		full := len(c.args) == 4 && strings.ToLower(c.args[3].StrVal()) == "full"
+		stats := "[Dictionary HT]\n" + server.db.data.GetStats(full) + "[Expires HT]\n" + server.db.expire.GetStats(full)
+		c.AddReplyVerbatim(stats, "txt")
+	case sub == "dict-resizing" && len(c.args) == 3:
+		enable, ok := getLongFromObjectOrReply(c, c.args[2], "")
+		if !ok {
+			return
+		}
+		if enable != 0 {
+			dict.SetResizeEnabled(dict.RESIZE_ENABLE)
+		} else {
+			dict.SetResizeEnabled(dict.RESIZE_FORBID)
+		}
+		c.AddReplyStatus("OK")
+	default:
+		c.AddReplySubcommandSyntaxError()
+	}
+}
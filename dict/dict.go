@@ -0,0 +1,696 @@
+/*
+Package dict 渐进式rehash的哈希表
+key和value的类型由泛型参数决定，哈希、比较、复制、释放都通过DictType传进来
+*/
+package dict
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	DEFAULT_STEP       int   = 1
+	INIT_SIZE          int64 = 8
+	GROW_RATIO         int64 = 2 // 扩容的增长率
+	HASHTABLE_MIN_FILL int64 = 8 // 负载因子低于 1/MIN_FILL 就缩容
+	DICT_STATS_VECTLEN int   = 50
+)
+
+// 能不能调整哈希表的大小
+const (
+	RESIZE_ENABLE int = 0 // 随便调
+	RESIZE_FORBID int = 1 // 不许调
+)
+
+var dictCanResize = RESIZE_ENABLE
+
+// 对所有字典生效
+func SetResizeEnabled(mode int) {
+	dictCanResize = mode
+}
+
+var (
+	EP_ERR = errors.New("expand error")
+	EX_ERR = errors.New("key exists error")
+	NK_ERR = errors.New("key doesnt exist error")
+)
+
+/*
+字典类型
+求哈希和比较是必须的，其他都可以不设置
+KeyDup/ValDup 在放进字典的时候调用，返回值才是真正存进去的，引用计数可以在这里加
+KeyDestructor/ValDestructor 在entry被删掉或者value被覆盖的时候调用
+Malloc/Free 报告entry和哈希表本身占的内存，给调用方做内存统计
+*/
+type DictType[K, V any] struct {
+	HashFunc      func(key K) uint64
+	EqualFunc     func(k1, k2 K) bool
+	KeyDup        func(key K) K
+	ValDup        func(val V) V
+	KeyDestructor func(key K)
+	ValDestructor func(val V)
+	Malloc        func(size int64)
+	Free          func(size int64)
+}
+
+type Entry[K, V any] struct {
+	Key  K
+	Val  V
+	next *Entry[K, V]
+}
+
+type htable[K, V any] struct {
+	table []*Entry[K, V]
+	size  int64
+	mask  int64
+	used  int64
+}
+
+type Dict[K, V any] struct {
+	DictType[K, V]
+	hts         [2]*htable[K, V]
+	rehashidx   int64
+	pauseRehash int // 安全迭代器的数量，大于0的时候不rehash
+}
+
+func New[K, V any](dictType DictType[K, V]) *Dict[K, V] {
+	var dict Dict[K, V]
+	dict.DictType = dictType
+	dict.rehashidx = -1 // 先设为-1
+	return &dict
+}
+
+// entry和哈希表头的大小，统计内存用
+func (dict *Dict[K, V]) entrySize() int64 {
+	return int64(unsafe.Sizeof(Entry[K, V]{}))
+}
+
+func (dict *Dict[K, V]) tableSize(size int64) int64 {
+	return int64(unsafe.Sizeof(htable[K, V]{})) + size*int64(unsafe.Sizeof(uintptr(0)))
+}
+
+func (dict *Dict[K, V]) malloc(size int64) {
+	if dict.Malloc != nil {
+		dict.Malloc(size)
+	}
+}
+
+func (dict *Dict[K, V]) free(size int64) {
+	if dict.Free != nil {
+		dict.Free(size)
+	}
+}
+
+// 哈希表和entry本身占的内存，不算key和value
+func (dict *Dict[K, V]) MemUsage() int64 {
+	var size int64
+	for _, ht := range dict.hts {
+		if ht != nil {
+			size += dict.tableSize(ht.size) + ht.used*dict.entrySize()
+		}
+	}
+	return size
+}
+
+// 是否在rehash
+func (dict *Dict[K, V]) IsRehashing() bool {
+	return dict.rehashidx != -1
+}
+
+// 有安全迭代器的时候不能挪entry，不然迭代的时候会漏掉或者重复
+func (dict *Dict[K, V]) rehashStep() {
+	if dict.pauseRehash == 0 {
+		dict.rehash(DEFAULT_STEP)
+	}
+}
+
+/*
+所谓rehash
+就是要将字典中的键值对重新分布到新的哈希表里面
+1. 只要step大于0，就一直进行
+2. 找到还没迁移的槽，最多跳过 step*10 个空槽，免得表很空的时候一次卡太久
+3. 遍历这个槽(链地址法)
+4. 根据mask找到这个entry的再hts[1]中的槽
+5. 一次只处理一个槽，通过step的值来调整rehash的槽位数量
+6. 如果hts[0].used == 0 说明已经迁移完了，hts[1]变成hts[0]
+返回值表示还有没有没迁移完的槽
+*/
+func (dict *Dict[K, V]) rehash(step int) bool {
+	emptyVisits := step * 10
+	for step > 0 && dict.hts[0].used != 0 {
+		for dict.hts[0].table[dict.rehashidx] == nil {
+			dict.rehashidx++
+			emptyVisits--
+			if emptyVisits == 0 {
+				return true
+			}
+		}
+		entry := dict.hts[0].table[dict.rehashidx]
+		for entry != nil {
+			ne := entry.next
+			idx := int64(dict.HashFunc(entry.Key)) & dict.hts[1].mask
+			entry.next = dict.hts[1].table[idx] // 头插法
+			dict.hts[1].table[idx] = entry
+			dict.hts[0].used--
+			dict.hts[1].used++
+			entry = ne
+		}
+		dict.hts[0].table[dict.rehashidx] = nil
+		dict.rehashidx++
+		step--
+	}
+	if dict.hts[0].used == 0 {
+		dict.free(dict.tableSize(dict.hts[0].size))
+		dict.hts[0] = dict.hts[1]
+		dict.hts[1] = nil
+		dict.rehashidx = -1
+		return false
+	}
+	return true
+}
+
+/*
+在ms毫秒之内尽量多rehash，每轮100个槽，返回rehash了多少个槽
+*/
+func (dict *Dict[K, V]) RehashMilliseconds(ms int64) int {
+	if !dict.IsRehashing() || dict.pauseRehash > 0 {
+		return 0
+	}
+	start := time.Now().UnixMilli()
+	rehashes := 0
+	for dict.rehash(100) {
+		rehashes += 100
+		if time.Now().UnixMilli()-start > ms {
+			break
+		}
+	}
+	return rehashes
+}
+
+/*
+找到大于等于size的最小的2的幂
+*/
+func nextPower(size int64) int64 {
+	for i := INIT_SIZE; i < math.MaxInt64; i *= 2 {
+		if i >= size {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+扩容
+1. 根据size拿到一个2的幂次的值,作为下一次的size
+2. 比现在的表小的话不算扩容
+*/
+func (dict *Dict[K, V]) expand(size int64) error {
+	sz := nextPower(size)
+	if dict.IsRehashing() || (dict.hts[0] != nil && dict.hts[0].size >= sz) {
+		return EP_ERR
+	}
+	return dict.resize(sz)
+}
+
+/*
+缩容，新表要能装下所有元素
+*/
+func (dict *Dict[K, V]) shrink(size int64) error {
+	sz := nextPower(size)
+	if dict.IsRehashing() || dict.hts[0] == nil || dict.hts[0].size <= sz || dict.hts[0].used > sz {
+		return EP_ERR
+	}
+	return dict.resize(sz)
+}
+
+/*
+新建一个sz大小的表
+初始状态直接作为hts[0]，否则作为hts[1]开始rehash
+*/
+func (dict *Dict[K, V]) resize(sz int64) error {
+	var ht htable[K, V]
+	ht.size = sz
+	ht.mask = sz - 1
+	ht.used = 0
+	ht.table = make([]*Entry[K, V], sz)
+	dict.malloc(dict.tableSize(sz))
+	// 检查是不是在初始状态
+	if dict.hts[0] == nil {
+		dict.hts[0] = &ht
+		return nil
+	}
+	dict.hts[1] = &ht
+	dict.rehashidx = 0
+	return nil
+}
+
+/*
+是否需要扩容
+如果要扩容，就扩喽.
+扩容不是一个很费事的操作
+*/
+func (dict *Dict[K, V]) expandIfNeeded() error {
+	if dict.IsRehashing() { // 如果正在 rehash 直接返回
+		return nil
+	}
+	if dict.hts[0] == nil { // 初始状态
+		return dict.expand(INIT_SIZE)
+	}
+	// 负载因子到1了就扩容
+	used, size := dict.hts[0].used, dict.hts[0].size
+	if dictCanResize == RESIZE_ENABLE && used >= size {
+		return dict.expand(size * GROW_RATIO)
+	}
+	return nil
+}
+
+/*
+是否需要缩容
+删除之后和ServerCron里调用，负载因子低于 1/HASHTABLE_MIN_FILL 就缩到刚好装得下
+*/
+func (dict *Dict[K, V]) ShrinkIfNeeded() error {
+	if dict.IsRehashing() || dict.hts[0] == nil || dict.hts[0].size <= INIT_SIZE {
+		return nil
+	}
+	used, size := dict.hts[0].used, dict.hts[0].size
+	if dictCanResize == RESIZE_ENABLE && used*HASHTABLE_MIN_FILL <= size {
+		return dict.shrink(used)
+	}
+	return nil
+}
+
+/*
+找一个空闲槽位
+1. 如果要扩容，先扩容
+2. 遍历两个表，去找一个合适的槽
+3. 先拿到idx，然后拿到entry
+4. 然后拿到遍历entry所在的槽，如果key已经在里面了，直接返回-1
+5. 如果没有在rehash，那么找第一个table就够了。
+*/
+func (dict *Dict[K, V]) keyIndex(key K) int64 {
+	err := dict.expandIfNeeded()
+	if err != nil {
+		return -1
+	}
+	h := int64(dict.HashFunc(key))
+	var idx int64
+	for i := 0; i <= 1; i++ {
+		idx = h & dict.hts[i].mask
+		e := dict.hts[i].table[idx]
+		for e != nil {
+			if dict.EqualFunc(e.Key, key) {
+				return -1
+			}
+			e = e.next
+		}
+		if !dict.IsRehashing() { // 如果没有在rehash,那么找第一个表就够了
+			break
+		}
+	}
+	return idx
+}
+
+/*
+只放key，value由调用方自己填
+*/
+func (dict *Dict[K, V]) AddRaw(key K) *Entry[K, V] {
+	if dict.IsRehashing() {
+		dict.rehashStep()
+	}
+	index := dict.keyIndex(key)
+	if index == -1 {
+		return nil
+	}
+
+	var ht *htable[K, V]
+	if dict.IsRehashing() { // 如果正在rehash，就会王第二个表里插
+		ht = dict.hts[1]
+	} else {
+		ht = dict.hts[0]
+	}
+	var e Entry[K, V]
+	e.Key = key
+	if dict.KeyDup != nil {
+		e.Key = dict.KeyDup(key)
+	}
+	dict.malloc(dict.entrySize())
+	e.next = ht.table[index]
+	ht.table[index] = &e
+	ht.used++
+	return &e
+}
+
+func (dict *Dict[K, V]) Add(key K, val V) error {
+	entry := dict.AddRaw(key)
+	if entry == nil {
+		return EX_ERR
+	}
+	dict.setVal(entry, val)
+	return nil
+}
+
+func (dict *Dict[K, V]) setVal(entry *Entry[K, V], val V) {
+	if dict.ValDup != nil {
+		val = dict.ValDup(val)
+	}
+	entry.Val = val
+}
+
+/*
+key存在就覆盖value
+先放新的再释放旧的，新旧是同一个对象的时候也不会被提前释放
+*/
+func (dict *Dict[K, V]) Set(key K, val V) {
+	err := dict.Add(key, val)
+	if err == nil { // 如果key不存在，并且已经设置好了,直接返回
+		return
+	}
+	entry := dict.Find(key) // 如果key存在，那就重新设置一下
+	old := entry.Val
+	dict.setVal(entry, val)
+	if dict.ValDestructor != nil {
+		dict.ValDestructor(old)
+	}
+}
+
+/*
+删除key
+1. 是不是初始状态
+2. 是否在rehash，如果在rehash，就进行一下，默认一个step
+3. 还是跟之前一样，去两天ht里面找，然后进行删除就ok了。
+4. 删掉之后看看要不要缩容，有安全迭代器的时候不缩
+*/
+func (dict *Dict[K, V]) Delete(key K) error {
+	if dict.hts[0] == nil { //初始状态
+		return NK_ERR
+	}
+	if dict.IsRehashing() {
+		dict.rehashStep()
+	}
+	h := int64(dict.HashFunc(key))
+	for i := 0; i <= 1; i++ {
+		idx := dict.hts[i].mask & h
+		entry := dict.hts[i].table[idx]
+		var pre *Entry[K, V]
+		for entry != nil {
+			if dict.EqualFunc(entry.Key, key) {
+				if pre == nil {
+					dict.hts[i].table[idx] = entry.next
+				} else {
+					pre.next = entry.next
+				}
+				dict.hts[i].used--
+				dict.freeEntry(entry)
+				if dict.pauseRehash == 0 { // 有安全迭代器的时候不缩容，免得迭代到一半换了表
+					dict.ShrinkIfNeeded()
+				}
+				return nil
+			}
+			pre = entry
+			entry = entry.next
+		}
+		if !dict.IsRehashing() { //还是那样，如果没有在rehash，那就不需要再进入下一个ht了
+			break
+		}
+	}
+	return NK_ERR
+}
+
+/*
+释放元素
+*/
+func (dict *Dict[K, V]) freeEntry(e *Entry[K, V]) {
+	dict.free(dict.entrySize())
+	if dict.KeyDestructor != nil {
+		dict.KeyDestructor(e.Key)
+	}
+	if dict.ValDestructor != nil {
+		dict.ValDestructor(e.Val)
+	}
+}
+
+/*
+find函数，找到对应的entry
+*/
+func (dict *Dict[K, V]) Find(key K) *Entry[K, V] {
+	if dict.hts[0] == nil {
+		return nil
+	}
+	if dict.IsRehashing() {
+		dict.rehashStep()
+	}
+	h := int64(dict.HashFunc(key))
+	for i := 0; i <= 1; i++ {
+		idx := dict.hts[i].mask & h
+		e := dict.hts[i].table[idx]
+		for e != nil {
+			if dict.EqualFunc(e.Key, key) {
+				return e
+			} else {
+				e = e.next
+			}
+		}
+		if !dict.IsRehashing() {
+			break
+		}
+	}
+	return nil
+}
+
+// 字典中元素的数量
+func (dict *Dict[K, V]) Size() int64 {
+	var size int64
+	for _, ht := range dict.hts {
+		if ht != nil {
+			size += ht.used
+		}
+	}
+	return size
+}
+
+// key不存在的时候返回V的零值
+func (dict *Dict[K, V]) Get(key K) V {
+	entry := dict.Find(key)
+	if entry != nil {
+		return entry.Val
+	}
+	var zero V
+	return zero
+}
+
+/*
+随机拿一个
+*/
+func (dict *Dict[K, V]) RandomGet() *Entry[K, V] {
+	if dict.hts[0] == nil {
+		return nil
+	}
+	t := 0
+	if dict.IsRehashing() {
+		dict.rehashStep()
+		// 	如果正在rehash，就从更大的那个表里随机拿
+		if dict.hts[1] != nil && dict.hts[1].used > dict.hts[0].used {
+			t = 1
+		}
+	}
+	// 开始随机找到一个slot 1000次还没找到，直接完犊子算球
+	idx := rand.Int63n(dict.hts[t].size)
+	cnt := 0
+	for dict.hts[t].table[idx] == nil && cnt < 1000 {
+		idx = rand.Int63n(dict.hts[t].size)
+		cnt++
+	}
+	if dict.hts[t].table[idx] == nil {
+		return nil
+	}
+	// 拿到这一个slot的长度
+	var listLen int64
+	p := dict.hts[t].table[idx]
+	for p != nil {
+		listLen++
+		p = p.next
+	}
+	listIdx := rand.Int63n(listLen)
+	p = dict.hts[t].table[idx]
+	for i := int64(0); i < listIdx; i++ {
+		p = p.next
+	}
+	return p
+}
+
+/*
+一个哈希表的统计信息：槽的使用情况和链长的分布
+*/
+func (ht *htable[K, V]) getStats(tableID int, full bool) string {
+	var sb strings.Builder
+	name := "main hash table"
+	if tableID == 1 {
+		name = "rehashing target"
+	}
+	if ht.used == 0 {
+		return fmt.Sprintf("Hash table %d stats (%s):\nNo stats available for empty dictionaries\n", tableID, name)
+	}
+	fmt.Fprintf(&sb, "Hash table %d stats (%s):\n table size: %d\n number of elements: %d\n", tableID, name, ht.size, ht.used)
+	if !full {
+		return sb.String()
+	}
+	var clvector [DICT_STATS_VECTLEN]int64
+	var slots, maxchainlen, totchainlen int64
+	for _, e := range ht.table {
+		if e == nil {
+			clvector[0]++
+			continue
+		}
+		slots++
+		var chainlen int64
+		for ; e != nil; e = e.next {
+			chainlen++
+		}
+		if chainlen < int64(DICT_STATS_VECTLEN) {
+			clvector[chainlen]++
+		} else {
+			clvector[DICT_STATS_VECTLEN-1]++
+		}
+		if chainlen > maxchainlen {
+			maxchainlen = chainlen
+		}
+		totchainlen += chainlen
+	}
+	fmt.Fprintf(&sb, " different slots: %d\n max chain length: %d\n", slots, maxchainlen)
+	fmt.Fprintf(&sb, " avg chain length (counted): %.02f\n avg chain length (computed): %.02f\n",
+		float64(totchainlen)/float64(slots), float64(ht.used)/float64(slots))
+	sb.WriteString(" Chain length distribution:\n")
+	for i, n := range clvector {
+		if n == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "   %d: %d (%.02f%%)\n", i, n, float64(n)*100/float64(ht.size))
+	}
+	return sb.String()
+}
+
+/*
+DEBUG HTSTATS 用的统计信息，两个表都算，full为false的时候不遍历槽
+*/
+func (dict *Dict[K, V]) GetStats(full bool) string {
+	if dict.hts[0] == nil {
+		return "Hash table 0 stats (main hash table):\nNo stats available for empty dictionaries\n"
+	}
+	stats := dict.hts[0].getStats(0, full)
+	if dict.IsRehashing() {
+		stats += dict.hts[1].getStats(1, full)
+	}
+	return stats
+}
+
+/*
+迭代器
+普通迭代器：迭代期间不能改字典，Release的时候检查指纹，改过就panic
+安全迭代器：迭代期间暂停rehash，可以删掉刚拿到的entry
+*/
+type Iterator[K, V any] struct {
+	dict        *Dict[K, V]
+	table       int
+	index       int64
+	safe        bool
+	entry       *Entry[K, V]
+	nextEntry   *Entry[K, V]
+	fingerprint uint64
+	started     bool
+}
+
+func (dict *Dict[K, V]) Iterator() *Iterator[K, V] {
+	return &Iterator[K, V]{dict: dict, index: -1}
+}
+
+func (dict *Dict[K, V]) SafeIterator() *Iterator[K, V] {
+	return &Iterator[K, V]{dict: dict, index: -1, safe: true}
+}
+
+/*
+字典的指纹，两张表的大小和元素个数混在一起算
+迭代前后指纹不一样，说明迭代期间字典被改了
+*/
+func (dict *Dict[K, V]) fingerprint() uint64 {
+	var integers [6]int64
+	for i, ht := range dict.hts {
+		if ht != nil {
+			integers[i*3] = int64(uintptr(unsafe.Pointer(ht)))
+			integers[i*3+1] = ht.size
+			integers[i*3+2] = ht.used
+		}
+	}
+	var hash uint64
+	for _, n := range integers {
+		hash += uint64(n)
+		hash = ^hash + hash<<21
+		hash ^= hash >> 24
+		hash = (hash + hash<<3) + hash<<8
+		hash ^= hash >> 14
+		hash = (hash + hash<<2) + hash<<4
+		hash ^= hash >> 28
+		hash += hash << 31
+	}
+	return hash
+}
+
+/*
+拿下一个entry，没有了返回nil
+1. 第一次调用的时候，安全迭代器暂停rehash，普通迭代器记下指纹
+2. 当前槽走完了就去下一个槽，表0走完了，如果在rehash就接着走表1
+3. 先记住下一个entry，这样调用方删掉当前entry也不影响
+*/
+func (it *Iterator[K, V]) Next() *Entry[K, V] {
+	for {
+		if it.entry == nil {
+			if !it.started {
+				it.started = true
+				if it.safe {
+					it.dict.pauseRehash++
+				} else {
+					it.fingerprint = it.dict.fingerprint()
+				}
+			}
+			ht := it.dict.hts[it.table]
+			if ht == nil {
+				return nil
+			}
+			it.index++
+			if it.index >= ht.size {
+				if it.dict.IsRehashing() && it.table == 0 {
+					it.table++
+					it.index = 0
+					ht = it.dict.hts[1]
+				} else {
+					return nil
+				}
+			}
+			it.entry = ht.table[it.index]
+		} else {
+			it.entry = it.nextEntry
+		}
+		if it.entry != nil {
+			it.nextEntry = it.entry.next
+			return it.entry
+		}
+	}
+}
+
+// 迭代完了一定要调用
+func (it *Iterator[K, V]) Release() {
+	if !it.started {
+		return
+	}
+	if it.safe {
+		it.dict.pauseRehash--
+	} else if it.fingerprint != it.dict.fingerprint() {
+		panic("dict: modified during unsafe iteration")
+	}
+	it.started = false
+}
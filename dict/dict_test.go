@@ -0,0 +1,172 @@
+package dict
+
+import (
+	"strconv"
+	"testing"
+)
+
+func newTestDict() *Dict[string, int] {
+	return New(DictType[string, int]{
+		HashFunc:  func(key string) uint64 { return GenHashFunction([]byte(key)) },
+		EqualFunc: func(k1, k2 string) bool { return k1 == k2 },
+	})
+}
+
+func checkAll(t *testing.T, d *Dict[string, int], n int) {
+	t.Helper()
+	if d.Size() != int64(n) {
+		t.Fatalf("size = %d, want %d", d.Size(), n)
+	}
+	for i := 0; i < n; i++ {
+		k := strconv.Itoa(i)
+		if e := d.Find(k); e == nil || e.Val != i {
+			t.Fatalf("key %s: got %v, want %d", k, e, i)
+		}
+	}
+}
+
+func TestSetGetDeleteDuringRehash(t *testing.T) {
+	d := newTestDict()
+	sawRehash := false
+	for i := 0; i < 1000; i++ {
+		d.Set(strconv.Itoa(i), i)
+		if d.IsRehashing() {
+			sawRehash = true
+			// rehash走到一半的时候，两张表里的key都要能找到
+			checkAll(t, d, i+1)
+		}
+	}
+	if !sawRehash {
+		t.Fatal("dict never rehashed while growing")
+	}
+	checkAll(t, d, 1000)
+
+	// 覆盖
+	for i := 0; i < 1000; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+	checkAll(t, d, 1000)
+
+	for i := 999; i >= 500; i-- {
+		if err := d.Delete(strconv.Itoa(i)); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	checkAll(t, d, 500)
+	if err := d.Delete("999"); err != NK_ERR {
+		t.Fatalf("delete missing key: got %v, want NK_ERR", err)
+	}
+	if v := d.Get("999"); v != 0 {
+		t.Fatalf("get missing key: got %d, want 0", v)
+	}
+}
+
+func TestShrinkAfterDelete(t *testing.T) {
+	d := newTestDict()
+	for i := 0; i < 1024; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+	for d.IsRehashing() {
+		d.rehash(100)
+	}
+	big := d.hts[0].size
+	for i := 1023; i >= 10; i-- {
+		d.Delete(strconv.Itoa(i))
+	}
+	for d.IsRehashing() {
+		d.rehash(100)
+	}
+	if d.hts[0].size >= big {
+		t.Fatalf("table size %d did not shrink from %d", d.hts[0].size, big)
+	}
+	checkAll(t, d, 10)
+}
+
+func TestShrinkForbidden(t *testing.T) {
+	SetResizeEnabled(RESIZE_FORBID)
+	defer SetResizeEnabled(RESIZE_ENABLE)
+	d := newTestDict()
+	for i := 0; i < 100; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+	size := d.hts[0].size
+	for i := 0; i < 100; i++ {
+		d.Delete(strconv.Itoa(i))
+	}
+	if d.IsRehashing() || d.hts[0].size != size {
+		t.Fatalf("table resized while RESIZE_FORBID")
+	}
+}
+
+func TestSafeIteratorDelete(t *testing.T) {
+	d := newTestDict()
+	for i := 0; i < 1000; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+	for d.IsRehashing() {
+		d.rehash(100)
+	}
+	seen := make(map[string]bool)
+	it := d.SafeIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		if seen[e.Key] {
+			t.Fatalf("key %s visited twice", e.Key)
+		}
+		seen[e.Key] = true
+		if e.Val%10 != 1 {
+			d.Delete(e.Key)
+		}
+	}
+	// 删掉了九成，但是迭代期间不能开始缩容
+	if d.IsRehashing() {
+		t.Fatal("dict started rehashing during safe iteration")
+	}
+	if d.pauseRehash != 1 {
+		t.Fatalf("pauseRehash = %d during safe iteration, want 1", d.pauseRehash)
+	}
+	it.Release()
+	if d.pauseRehash != 0 {
+		t.Fatalf("pauseRehash = %d after release, want 0", d.pauseRehash)
+	}
+	if len(seen) != 1000 {
+		t.Fatalf("visited %d keys, want 1000", len(seen))
+	}
+	if d.Size() != 100 {
+		t.Fatalf("size = %d, want 100", d.Size())
+	}
+	for i := 1; i < 1000; i += 10 {
+		if d.Get(strconv.Itoa(i)) != i {
+			t.Fatalf("key %d lost", i)
+		}
+	}
+	d.ShrinkIfNeeded()
+	if !d.IsRehashing() {
+		t.Fatal("dict did not shrink after safe iteration")
+	}
+}
+
+func TestUnsafeIteratorFingerprint(t *testing.T) {
+	d := newTestDict()
+	for i := 0; i < 10; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+	it := d.Iterator()
+	n := 0
+	for e := it.Next(); e != nil; e = it.Next() {
+		n++
+	}
+	it.Release() // 没改过，不会panic
+	if n != 10 {
+		t.Fatalf("visited %d keys, want 10", n)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("modifying the dict during unsafe iteration did not panic")
+		}
+	}()
+	it = d.Iterator()
+	it.Next()
+	d.Set("new", 100)
+	it.Release()
+}
@@ -0,0 +1,85 @@
+package dict
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+/*
+SipHash-2-4
+带密钥的哈希，不知道种子就没法构造出一堆落在同一个槽里的key
+每个进程启动时随机一个种子，见 SetHashFunctionSeed
+*/
+
+// 哈希函数的种子，要在创建字典之前设置好，之后再改的话已有的key就找不到了
+var hashFunctionSeed [16]byte
+
+func SetHashFunctionSeed(seed []byte) {
+	copy(hashFunctionSeed[:], seed)
+}
+
+func GetHashFunctionSeed() []byte {
+	return hashFunctionSeed[:]
+}
+
+// 给HashFunc用的带种子的哈希
+func GenHashFunction(key []byte) uint64 {
+	return siphash(key, &hashFunctionSeed)
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
+
+/*
+1. 用16字节的密钥初始化4个状态
+2. 每8个字节压缩一次(2轮)
+3. 剩下不到8个字节的和长度拼成最后一块
+4. 收尾4轮
+*/
+func siphash(in []byte, k *[16]byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(k[0:8])
+	k1 := binary.LittleEndian.Uint64(k[8:16])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	b := uint64(len(in)) << 56
+	for len(in) >= 8 {
+		m := binary.LittleEndian.Uint64(in)
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+		in = in[8:]
+	}
+	for i := len(in) - 1; i >= 0; i-- {
+		b |= uint64(in[i]) << (8 * uint(i))
+	}
+
+	v3 ^= b
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= b
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+/*
+内存淘汰 maxmemory / maxmemory-policy
+和redis一样是近似的LRU/LFU：每次从字典里随机抽 maxmemory-samples 个key，
+放进按空闲程度排好序的淘汰池，再从池子里挑最该淘汰的那个删掉，直到内存降到maxmemory以下
+*/
+
+const (
+	MAXMEMORY_FLAG_LRU     int = 1 << 0
+	MAXMEMORY_FLAG_LFU     int = 1 << 1
+	MAXMEMORY_FLAG_ALLKEYS int = 1 << 2
+
+	MAXMEMORY_VOLATILE_LRU    int = (0 << 8) | MAXMEMORY_FLAG_LRU
+	MAXMEMORY_VOLATILE_LFU    int = (1 << 8) | MAXMEMORY_FLAG_LFU
+	MAXMEMORY_VOLATILE_TTL    int = 2 << 8
+	MAXMEMORY_VOLATILE_RANDOM int = 3 << 8
+	MAXMEMORY_ALLKEYS_LRU     int = (4 << 8) | MAXMEMORY_FLAG_LRU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_LFU     int = (5 << 8) | MAXMEMORY_FLAG_LFU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_RANDOM  int = (6 << 8) | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_NO_EVICTION     int = 7 << 8
+)
+
+const (
+	EVPOOL_SIZE int = 16 // 淘汰池的大小
+
+	LRU_BITS             int    = 24
+	LRU_CLOCK_MAX        uint32 = 1<<LRU_BITS - 1
+	LRU_CLOCK_RESOLUTION int64  = 1000 // LRU时钟的精度(ms)
+
+	LFU_INIT_VAL uint32 = 5 // 新对象的访问计数，不然刚创建就被淘汰了
+
+	EVICT_OK   int = 0
+	EVICT_FAIL int = 1
+)
+
+var maxmemoryPolicyNames = map[string]int{
+	"volatile-lru":    MAXMEMORY_VOLATILE_LRU,
+	"volatile-lfu":    MAXMEMORY_VOLATILE_LFU,
+	"volatile-ttl":    MAXMEMORY_VOLATILE_TTL,
+	"volatile-random": MAXMEMORY_VOLATILE_RANDOM,
+	"allkeys-lru":     MAXMEMORY_ALLKEYS_LRU,
+	"allkeys-lfu":     MAXMEMORY_ALLKEYS_LFU,
+	"allkeys-random":  MAXMEMORY_ALLKEYS_RANDOM,
+	"noeviction":      MAXMEMORY_NO_EVICTION,
+}
+
+func maxmemoryPolicyFromString(s string) (int, error) {
+	policy, ok := maxmemoryPolicyNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid maxmemory-policy: %s", s)
+	}
+	return policy, nil
+}
+
+func maxmemoryPolicyToString(policy int) string {
+	for name, p := range maxmemoryPolicyNames {
+		if p == policy {
+			return name
+		}
+	}
+	return ""
+}
+
+// 淘汰池里的一项，idle越大越该被淘汰
+type evictionPoolEntry struct {
+	idle uint64
+	key  string
+}
+
+/*
+LRU时钟，秒级精度，24位会回绕
+*/
+func getLRUClock() uint32 {
+	return uint32(GetMsTime()/LRU_CLOCK_RESOLUTION) & LRU_CLOCK_MAX
+}
+
+// ServerCron里会更新server.lruclock，精度够用的时候直接拿缓存的值
+func LRU_CLOCK() uint32 {
+	return server.lruclock
+}
+
+// 对象多久没被访问了(ms)
+func estimateObjectIdleTime(o *Gobj) uint64 {
+	lruclock := LRU_CLOCK()
+	if lruclock >= o.lru {
+		return uint64(lruclock-o.lru) * uint64(LRU_CLOCK_RESOLUTION)
+	}
+	return uint64(lruclock+(LRU_CLOCK_MAX-o.lru)) * uint64(LRU_CLOCK_RESOLUTION)
+}
+
+/*
+LFU
+lru字段的高16位是上次计数衰减的时间(分钟)，低8位是对数计数器
+*/
+func LFUGetTimeInMinutes() uint32 {
+	return uint32(GetMsTime()/1000/60) & 65535
+}
+
+// 距离ldt过去了多少分钟，考虑回绕
+func LFUTimeElapsed(ldt uint32) uint32 {
+	now := LFUGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+/*
+对数增长，计数越大越难加一
+lfu-log-factor越大增长越慢
+*/
+func LFULogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := float64(counter) - float64(LFU_INIT_VAL)
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(server.lfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+/*
+按过去的时间衰减计数，每 lfu-decay-time 分钟减一
+只返回衰减后的值，不修改对象
+*/
+func LFUDecrAndReturn(o *Gobj) uint32 {
+	ldt := o.lru >> 8
+	counter := o.lru & 255
+	var periods uint32
+	if server.lfuDecayTime > 0 {
+		periods = LFUTimeElapsed(ldt) / uint32(server.lfuDecayTime)
+	}
+	if periods > counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// 访问了一次对象，先衰减再加一
+func updateLFU(o *Gobj) {
+	counter := LFUDecrAndReturn(o)
+	counter = LFULogIncr(counter)
+	o.lru = LFUGetTimeInMinutes()<<8 | counter
+}
+
+// 新对象的lru字段
+func initObjectLRU() uint32 {
+	if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		return LFUGetTimeInMinutes()<<8 | LFU_INIT_VAL
+	}
+	return LRU_CLOCK()
+}
+
+// 查找key的时候更新访问时间或者访问计数
+func updateObjectAccess(o *Gobj) {
+	if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		updateLFU(o)
+	} else {
+		o.lru = LRU_CLOCK()
+	}
+}
+
+/*
+从字典里抽样，放进淘汰池
+1. sampledict 是 db.data(allkeys) 或者 db.expire(volatile)
+2. 根据策略算出idle，LRU是空闲时间，LFU是255减访问计数，TTL是越快过期越大
+3. 池子按idle从小到大排，池子满了的话，比最小的还小就不要了，否则挤掉最小的
+返回有几个key可以淘汰
+*/
+func evictionPoolPopulate(sampledict *Dict) int {
+	policy := server.maxmemoryPolicy
+	sampled := 0
+	for i := 0; i < server.maxmemorySamples; i++ {
+		de := sampledict.RandomGet()
+		if de == nil {
+			continue
+		}
+		o := de.Val
+		if policy != MAXMEMORY_VOLATILE_TTL && sampledict == server.db.expire {
+			o = server.db.data.Get(de.Key)
+			if o == nil {
+				continue
+			}
+		}
+		var idle uint64
+		if policy&MAXMEMORY_FLAG_LRU != 0 {
+			idle = estimateObjectIdleTime(o)
+		} else if policy&MAXMEMORY_FLAG_LFU != 0 {
+			idle = 255 - uint64(LFUDecrAndReturn(o))
+		} else {
+			idle = math.MaxUint64 - uint64(o.IntVal())
+		}
+		sampled++
+		evictionPoolInsert(de.Key.StrVal(), idle)
+	}
+	return sampled
+}
+
+func evictionPoolInsert(key string, idle uint64) {
+	pool := server.evictionPool
+	for _, e := range pool {
+		if e.key == key {
+			return
+		}
+	}
+	if len(pool) == EVPOOL_SIZE && idle <= pool[0].idle {
+		return
+	}
+	k := 0
+	for k < len(pool) && pool[k].idle < idle {
+		k++
+	}
+	pool = append(pool, evictionPoolEntry{})
+	copy(pool[k+1:], pool[k:])
+	pool[k] = evictionPoolEntry{idle: idle, key: key}
+	if len(pool) > EVPOOL_SIZE {
+		pool = pool[1:]
+	}
+	server.evictionPool = pool
+}
+
+/*
+选出要淘汰的key，没有可以淘汰的返回nil
+1. LRU/LFU/TTL：抽样填充淘汰池，从idle最大的开始拿，池子里的key可能已经被删了，要再检查一下
+2. RANDOM：随便拿一个
+*/
+func evictionSelectKey() *Gobj {
+	policy := server.maxmemoryPolicy
+	dict := server.db.expire
+	if policy&MAXMEMORY_FLAG_ALLKEYS != 0 {
+		dict = server.db.data
+	}
+	if dict.Size() == 0 {
+		return nil
+	}
+	if policy == MAXMEMORY_ALLKEYS_RANDOM || policy == MAXMEMORY_VOLATILE_RANDOM {
+		de := dict.RandomGet()
+		if de == nil {
+			return nil
+		}
+		return CreateObject(GSTR, de.Key.StrVal())
+	}
+	for {
+		if evictionPoolPopulate(dict) == 0 && len(server.evictionPool) == 0 {
+			return nil
+		}
+		for len(server.evictionPool) > 0 {
+			last := len(server.evictionPool) - 1
+			e := server.evictionPool[last]
+			server.evictionPool = server.evictionPool[:last]
+			key := CreateObject(GSTR, e.key)
+			if dict.Find(key) != nil {
+				return key
+			}
+			key.DecrRefCount()
+		}
+	}
+}
+
+/*
+内存超过maxmemory的时候淘汰key，在执行命令之前调用
+noeviction或者没有可以淘汰的key了，返回EVICT_FAIL
+*/
+func performEvictions() int {
+	if zmallocUsedMemory() <= server.maxmemory {
+		return EVICT_OK
+	}
+	if server.maxmemoryPolicy == MAXMEMORY_NO_EVICTION {
+		return EVICT_FAIL
+	}
+	for zmallocUsedMemory() > server.maxmemory {
+		key := evictionSelectKey()
+		if key == nil {
+			return EVICT_FAIL
+		}
+		dbDelete(key)
+		server.statEvictedKeys++
+		notifyKeyspaceEvent(NOTIFY_EVICTED, "evicted", key, 0)
+		signalModifiedKey(key)
+		key.DecrRefCount()
+	}
+	return EVICT_OK
+}
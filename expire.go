@@ -0,0 +1,44 @@
+package main
+
+const (
+	ACTIVE_EXPIRE_KEYS_PER_LOOP int64 = 20 // 每一轮抽样多少个key
+	ACTIVE_EXPIRE_TIME_LIMIT    int64 = 25 // 每次最多花多少毫秒
+)
+
+/*
+主动清理过期key，由ServerCron调用
+不主动清理的话，没人访问的key永远不会过期，也就发不出expired事件
+1. 从expire字典里随机拿一批key，过期了就删掉
+2. 如果过期的超过了四分之一，说明过期的key还很多，再来一轮
+3. 超过时间限制就停下，不能卡住事件循环
+*/
+func activeExpireCycle() {
+	start := GetMsTime()
+	for {
+		num := server.db.expire.Size()
+		if num == 0 {
+			return
+		}
+		if num > ACTIVE_EXPIRE_KEYS_PER_LOOP {
+			num = ACTIVE_EXPIRE_KEYS_PER_LOOP
+		}
+		var expired int64
+		now := GetMsTime()
+		for i := int64(0); i < num; i++ {
+			entry := server.db.expire.RandomGet()
+			if entry == nil {
+				break
+			}
+			if entry.Val.IntVal() <= now {
+				deleteExpiredKey(entry.Key)
+				expired++
+			}
+		}
+		if expired*4 <= num {
+			return
+		}
+		if GetMsTime()-start > ACTIVE_EXPIRE_TIME_LIMIT {
+			return
+		}
+	}
+}
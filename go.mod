@@ -3,3 +3,5 @@ module go-redis
 go 1.20
 
 require golang.org/x/sys v0.10.0
+
+require github.com/yuin/gopher-lua v1.1.1
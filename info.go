@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+/*
+INFO [section ...]
+不带参数或者default/all/everything时回复所有段，段名不区分大小写
+每一段以 # 段名 开头，下面是 名字:值，段之间空一行
+*/
+
+var infoSections = []string{"server", "clients", "memory", "stats", "errorstats", "keyspace"}
+
+func genInfoSection(section string) string {
+	var sb strings.Builder
+	switch section {
+	case "server":
+		sb.WriteString("# Server\r\n")
+		fmt.Fprintf(&sb, "redis_version:%s\r\n", GODIS_VERSION)
+		fmt.Fprintf(&sb, "go_version:%s\r\n", runtime.Version())
+		fmt.Fprintf(&sb, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&sb, "tcp_port:%d\r\n", server.port)
+		fmt.Fprintf(&sb, "uptime_in_seconds:%d\r\n", (GetMsTime()-server.statStartTime)/1000)
+	case "clients":
+		sb.WriteString("# Clients\r\n")
+		fmt.Fprintf(&sb, "connected_clients:%d\r\n", len(server.clients))
+	case "memory":
+		sb.WriteString("# Memory\r\n")
+		fmt.Fprintf(&sb, "used_memory:%d\r\n", zmallocUsedMemory())
+		fmt.Fprintf(&sb, "used_memory_peak:%d\r\n", server.statPeakMemory)
+		fmt.Fprintf(&sb, "used_memory_startup:%d\r\n", server.startupMemory)
+		fmt.Fprintf(&sb, "maxmemory:%d\r\n", server.maxmemory)
+		fmt.Fprintf(&sb, "maxmemory_policy:%s\r\n", maxmemoryPolicyToString(server.maxmemoryPolicy))
+	case "stats":
+		sb.WriteString("# Stats\r\n")
+		fmt.Fprintf(&sb, "total_connections_received:%d\r\n", server.statNumConnections)
+		fmt.Fprintf(&sb, "total_commands_processed:%d\r\n", server.statNumCommands)
+		fmt.Fprintf(&sb, "evicted_keys:%d\r\n", server.statEvictedKeys)
+		fmt.Fprintf(&sb, "total_error_replies:%d\r\n", server.statTotalErrorReplies)
+	case "errorstats":
+		sb.WriteString("# Errorstats\r\n")
+		codes := make([]string, 0, len(server.errorReplies))
+		for code := range server.errorReplies {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(&sb, "errorstat_%s:count=%d\r\n", code, server.errorReplies[code])
+		}
+	case "keyspace":
+		sb.WriteString("# Keyspace\r\n")
+		if keys := server.db.data.Size(); keys > 0 {
+			fmt.Fprintf(&sb, "db0:keys=%d,expires=%d\r\n", keys, server.db.expire.Size())
+		}
+	}
+	return sb.String()
+}
+
+func infoCommand(c *GodisClient) {
+	sections := infoSections
+	if len(c.args) > 1 {
+		sections = nil
+		for _, arg := range c.args[1:] {
+			name := strings.ToLower(arg.StrVal())
+			if name == "default" || name == "all" || name == "everything" {
+				sections = infoSections
+				break
+			}
+			sections = append(sections, name)
+		}
+	}
+	var info []string
+	for _, section := range sections {
+		if s := genInfoSection(section); s != "" {
+			info = append(info, s)
+		}
+	}
+	c.AddReplyVerbatim(strings.Join(info, "\r\n"), "txt")
+}
@@ -27,6 +27,7 @@ const (
 
 type FileProc func(loop *KeLoop, fd int, extra interface{}) // FileEvent的回调函数
 type TimeProc func(loop *KeLoop, id int, extra interface{}) // TimeEvent的回调函数
+type BeforeSleepProc func(loop *KeLoop)                     // 每次等待事件之前调用
 
 type KeFileEvent struct {
 	fd    int
@@ -51,6 +52,7 @@ type KeLoop struct {
 	fileEventFd     int
 	timeEventNextId int
 	stop            bool
+	beforeSleep     BeforeSleepProc
 }
 
 // 根据类型，确定一个Fe的Key   fd+mask 确定唯一的一个FileEvent
@@ -201,6 +203,21 @@ func (loop *KeLoop) KeWait() (tes []*KeTimeEvent, fes []*KeFileEvent) {
 	if timeout <= 0 {
 		timeout = 10
 	}
+	fes = loop.waitFileEvents(timeout)
+
+	now := GetMsTime()
+	p := loop.TimeEvents
+	for p != nil {
+		if p.when <= now {
+			tes = append(tes, p)
+		}
+		p = p.next
+	}
+	return
+}
+
+// epoll等待，收集就绪的FileEvent
+func (loop *KeLoop) waitFileEvents(timeout int64) (fes []*KeFileEvent) {
 	var events [128]unix.EpollEvent
 	n, err := unix.EpollWait(loop.fileEventFd, events[:], int(timeout)) // 如果timeout时间内还没有就绪，就要返回了，不能耽误TimeEvent
 	if err != nil {
@@ -225,18 +242,17 @@ func (loop *KeLoop) KeWait() (tes []*KeTimeEvent, fes []*KeFileEvent) {
 			}
 		}
 	}
-
-	now := GetMsTime()
-	p := loop.TimeEvents
-	for p != nil {
-		if p.when <= now {
-			tes = append(tes, p)
-		}
-		p = p.next
-	}
 	return
 }
 
+/*
+只处理文件事件，最多等timeout毫秒
+用在执行时间很长的命令(脚本)里，让其它客户端不至于完全没有响应
+*/
+func (loop *KeLoop) ProcessFileEvents(timeout int64) {
+	loop.KeProcess(nil, loop.waitFileEvents(timeout))
+}
+
 /*
 处理这两类事件
 对于tes 如果是一次性的事件，执行完移走
@@ -258,8 +274,15 @@ func (loop *KeLoop) KeProcess(tes []*KeTimeEvent, fes []*KeFileEvent) {
 	}
 }
 
+func (loop *KeLoop) SetBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforeSleep = proc
+}
+
 func (loop *KeLoop) KeMain() {
 	for loop.stop != true {
+		if loop.beforeSleep != nil {
+			loop.beforeSleep(loop)
+		}
 		tes, fes := loop.KeWait()
 		loop.KeProcess(tes, fes)
 	}
@@ -0,0 +1,185 @@
+/*
+Package list 双向链表
+元素类型由泛型参数决定，比较、复制、释放都通过ListType传进来
+*/
+package list
+
+import "unsafe"
+
+type Node[T any] struct {
+	Val  T
+	pre  *Node[T]
+	next *Node[T]
+}
+
+func (n *Node[T]) Next() *Node[T] {
+	return n.next
+}
+
+func (n *Node[T]) Prev() *Node[T] {
+	return n.pre
+}
+
+/*
+链表类型
+EqualFunc 给Find用，其他都可以不设置
+ValDup 在放进链表的时候调用，返回值才是真正存进去的
+ValDestructor 在节点被删掉的时候调用
+Malloc/Free 报告节点本身占的内存，给调用方做内存统计
+*/
+type ListType[T any] struct {
+	EqualFunc     func(a, b T) bool
+	ValDup        func(val T) T
+	ValDestructor func(val T)
+	Malloc        func(size int64)
+	Free          func(size int64)
+}
+
+// List数据结构 双向链表
+type List[T any] struct {
+	ListType[T]
+	head   *Node[T]
+	tail   *Node[T]
+	length int
+}
+
+// 链表创建
+func New[T any](listType ListType[T]) *List[T] {
+	var list List[T]
+	list.ListType = listType
+	return &list
+}
+
+// 节点本身的大小，统计内存用
+func (list *List[T]) nodeSize() int64 {
+	return int64(unsafe.Sizeof(Node[T]{}))
+}
+
+func (list *List[T]) Length() int {
+	return list.length
+}
+
+func (list *List[T]) First() *Node[T] {
+	return list.head
+}
+
+func (list *List[T]) Last() *Node[T] {
+	return list.tail
+}
+
+func (list *List[T]) Find(val T) *Node[T] {
+	t := list.head
+	for t != nil {
+		if list.EqualFunc(t.Val, val) {
+			break
+		}
+		t = t.next
+	}
+	return t
+}
+
+// 新建节点
+func (list *List[T]) newNode(val T) *Node[T] {
+	if list.Malloc != nil {
+		list.Malloc(list.nodeSize())
+	}
+	if list.ValDup != nil {
+		val = list.ValDup(val)
+	}
+	return &Node[T]{Val: val}
+}
+
+// 在尾部加
+func (list *List[T]) Append(val T) {
+	n := list.newNode(val)
+	if list.head == nil {
+		list.head = n
+		list.tail = n
+	} else {
+		n.pre = list.tail
+		list.tail.next = n
+		list.tail = list.tail.next
+	}
+	list.length++
+}
+
+// 在头部加
+func (list *List[T]) Lpush(val T) {
+	n := list.newNode(val)
+	if list.head == nil {
+		list.head = n
+		list.tail = n
+	} else {
+		list.head.pre = n
+		n.next = list.head
+		list.head = n
+	}
+	list.length++
+}
+
+func (list *List[T]) DelNode(n *Node[T]) {
+	if n == nil {
+		return
+	}
+	if list.Free != nil {
+		list.Free(list.nodeSize())
+	}
+	if list.ValDestructor != nil {
+		list.ValDestructor(n.Val)
+	}
+	if n.pre != nil {
+		n.pre.next = n.next
+	} else { // 删除的是头节点
+		list.head = n.next
+	}
+	if n.next != nil {
+		n.next.pre = n.pre
+	} else { // 删除的是尾节点
+		list.tail = n.pre
+	}
+	n.pre = nil
+	n.next = nil
+	list.length--
+}
+
+func (list *List[T]) Delete(val T) {
+	list.DelNode(list.Find(val))
+}
+
+// 迭代方向
+const (
+	HEAD = 0 // 从头往尾
+	TAIL = 1 // 从尾往头
+)
+
+/*
+迭代器
+先记住下一个节点，调用方删掉刚拿到的节点也不影响迭代
+*/
+type Iterator[T any] struct {
+	next      *Node[T]
+	direction int
+}
+
+func (list *List[T]) Iterator(direction int) *Iterator[T] {
+	it := &Iterator[T]{direction: direction}
+	if direction == HEAD {
+		it.next = list.head
+	} else {
+		it.next = list.tail
+	}
+	return it
+}
+
+// 拿下一个节点，没有了返回nil
+func (it *Iterator[T]) Next() *Node[T] {
+	current := it.next
+	if current != nil {
+		if it.direction == HEAD {
+			it.next = current.next
+		} else {
+			it.next = current.pre
+		}
+	}
+	return current
+}
@@ -0,0 +1,115 @@
+package list
+
+import "testing"
+
+func newTestList() *List[int] {
+	return New(ListType[int]{
+		EqualFunc: func(a, b int) bool { return a == b },
+	})
+}
+
+func checkList(t *testing.T, l *List[int], want ...int) {
+	t.Helper()
+	if l.Length() != len(want) {
+		t.Fatalf("length = %d, want %d", l.Length(), len(want))
+	}
+	var got []int
+	it := l.Iterator(HEAD)
+	for n := it.Next(); n != nil; n = it.Next() {
+		got = append(got, n.Val)
+	}
+	var back []int
+	it = l.Iterator(TAIL)
+	for n := it.Next(); n != nil; n = it.Next() {
+		back = append(back, n.Val)
+	}
+	if len(got) != len(want) || len(back) != len(want) {
+		t.Fatalf("iterated %v / %v, want %v", got, back, want)
+	}
+	for i := range want {
+		if got[i] != want[i] || back[len(want)-1-i] != want[i] {
+			t.Fatalf("iterated %v / %v, want %v", got, back, want)
+		}
+	}
+	if len(want) == 0 {
+		if l.First() != nil || l.Last() != nil {
+			t.Fatal("empty list has head or tail")
+		}
+		return
+	}
+	if l.First().Val != want[0] || l.Last().Val != want[len(want)-1] {
+		t.Fatalf("head/tail = %d/%d, want %d/%d", l.First().Val, l.Last().Val, want[0], want[len(want)-1])
+	}
+}
+
+func TestAppendLpush(t *testing.T) {
+	l := newTestList()
+	checkList(t, l)
+	l.Append(2)
+	l.Append(3)
+	l.Lpush(1)
+	l.Lpush(0)
+	checkList(t, l, 0, 1, 2, 3)
+}
+
+func TestDelNode(t *testing.T) {
+	l := newTestList()
+	for i := 0; i < 5; i++ {
+		l.Append(i)
+	}
+	l.DelNode(l.Find(2)) // 中间
+	checkList(t, l, 0, 1, 3, 4)
+	l.DelNode(l.First()) // 头
+	checkList(t, l, 1, 3, 4)
+	l.DelNode(l.Last()) // 尾
+	checkList(t, l, 1, 3)
+	l.Delete(3)
+	l.Delete(100) // 不存在的不动
+	checkList(t, l, 1)
+	l.DelNode(l.First()) // 最后一个
+	checkList(t, l)
+	l.Append(7)
+	checkList(t, l, 7)
+}
+
+func TestIteratorDeleteCurrent(t *testing.T) {
+	l := newTestList()
+	for i := 0; i < 6; i++ {
+		l.Append(i)
+	}
+	it := l.Iterator(HEAD)
+	for n := it.Next(); n != nil; n = it.Next() {
+		if n.Val%2 == 0 {
+			l.DelNode(n)
+		}
+	}
+	checkList(t, l, 1, 3, 5)
+	it = l.Iterator(TAIL)
+	for n := it.Next(); n != nil; n = it.Next() {
+		l.DelNode(n)
+	}
+	checkList(t, l)
+}
+
+func TestValDupDestructor(t *testing.T) {
+	freed := 0
+	var mem int64
+	l := New(ListType[int]{
+		EqualFunc:     func(a, b int) bool { return a == b },
+		ValDup:        func(val int) int { return val * 10 },
+		ValDestructor: func(val int) { freed += val },
+		Malloc:        func(size int64) { mem += size },
+		Free:          func(size int64) { mem -= size },
+	})
+	l.Append(1)
+	l.Lpush(2)
+	checkList(t, l, 20, 10)
+	if mem <= 0 {
+		t.Fatalf("mem = %d after adding nodes", mem)
+	}
+	l.Delete(10)
+	l.Delete(20)
+	if freed != 30 || mem != 0 {
+		t.Fatalf("freed = %d mem = %d, want 30 and 0", freed, mem)
+	}
+}
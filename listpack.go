@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+/*
+listpack，和redis的格式一样，一整块连续的内存
+<total-bytes 4字节> <num-elements 2字节> <entry> ... <entry> <0xFF>
+每个entry是 <encoding+data> <backlen>
+1. 能转成整数的字符串按整数存，小整数只占一个字节
+2. backlen是当前entry的长度，从后往前每个字节存7位，用来反向遍历
+元素个数超过65535的时候num-elements记为65535，要遍历才知道有多少个
+对外用entry在buf里的偏移来表示一个元素，-1表示没有
+*/
+
+const (
+	LP_HDR_SIZE           int  = 6
+	LP_HDR_NUMELE_UNKNOWN int  = 65535
+	LP_EOF                byte = 0xFF
+
+	LP_ENCODING_7BIT_UINT   byte = 0x00 // 0xxxxxxx
+	LP_ENCODING_6BIT_STR    byte = 0x80 // 10xxxxxx
+	LP_ENCODING_13BIT_INT   byte = 0xC0 // 110xxxxx yyyyyyyy
+	LP_ENCODING_12BIT_STR   byte = 0xE0 // 1110xxxx yyyyyyyy
+	LP_ENCODING_32BIT_STR   byte = 0xF0
+	LP_ENCODING_16BIT_INT   byte = 0xF1
+	LP_ENCODING_24BIT_INT   byte = 0xF2
+	LP_ENCODING_32BIT_INT   byte = 0xF3
+	LP_ENCODING_64BIT_INT   byte = 0xF4
+	LP_ENCODING_STR_MAX_LEN int  = 20 // 超过这个长度的字符串不尝试转整数
+
+	LP_BEFORE int = 0
+	LP_AFTER  int = 1
+)
+
+type Listpack struct {
+	buf []byte
+}
+
+func lpNew() *Listpack {
+	lp := &Listpack{buf: make([]byte, LP_HDR_SIZE+1)}
+	lp.setTotalBytes(LP_HDR_SIZE + 1)
+	lp.buf[LP_HDR_SIZE] = LP_EOF
+	zmalloc(int64(len(lp.buf)))
+	return lp
+}
+
+func (lp *Listpack) setTotalBytes(n int) {
+	binary.LittleEndian.PutUint32(lp.buf[0:4], uint32(n))
+}
+
+func (lp *Listpack) setNumElements(n int) {
+	if n >= LP_HDR_NUMELE_UNKNOWN {
+		n = LP_HDR_NUMELE_UNKNOWN
+	}
+	binary.LittleEndian.PutUint16(lp.buf[4:6], uint16(n))
+}
+
+// 整个listpack占多少字节
+func (lp *Listpack) Bytes() int {
+	return len(lp.buf)
+}
+
+func (lp *Listpack) Length() int {
+	n := int(binary.LittleEndian.Uint16(lp.buf[4:6]))
+	if n != LP_HDR_NUMELE_UNKNOWN {
+		return n
+	}
+	n = 0
+	for p := lp.First(); p != -1; p = lp.Next(p) {
+		n++
+	}
+	if n < LP_HDR_NUMELE_UNKNOWN {
+		lp.setNumElements(n)
+	}
+	return n
+}
+
+// 能不能按整数存，"012"、"+1"这种转回去不一样的不算
+func lpStringToInt64(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > LP_ENCODING_STR_MAX_LEN {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != s {
+		return 0, false
+	}
+	return v, true
+}
+
+/*
+把一个元素编码成 encoding+data
+*/
+func lpEncode(ele string) []byte {
+	if v, ok := lpStringToInt64(ele); ok {
+		switch {
+		case v >= 0 && v <= 127:
+			return []byte{byte(v)}
+		case v >= -4096 && v <= 4095:
+			uv := uint64(v) & 0x1FFF
+			return []byte{LP_ENCODING_13BIT_INT | byte(uv>>8), byte(uv)}
+		case v >= -32768 && v <= 32767:
+			return []byte{LP_ENCODING_16BIT_INT, byte(v), byte(v >> 8)}
+		case v >= -8388608 && v <= 8388607:
+			return []byte{LP_ENCODING_24BIT_INT, byte(v), byte(v >> 8), byte(v >> 16)}
+		case v >= -2147483648 && v <= 2147483647:
+			buf := []byte{LP_ENCODING_32BIT_INT, 0, 0, 0, 0}
+			binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+			return buf
+		default:
+			buf := make([]byte, 9)
+			buf[0] = LP_ENCODING_64BIT_INT
+			binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+			return buf
+		}
+	}
+	l := len(ele)
+	var buf []byte
+	switch {
+	case l < 64:
+		buf = make([]byte, 1, 1+l)
+		buf[0] = LP_ENCODING_6BIT_STR | byte(l)
+	case l < 4096:
+		buf = make([]byte, 2, 2+l)
+		buf[0] = LP_ENCODING_12BIT_STR | byte(l>>8)
+		buf[1] = byte(l)
+	default:
+		buf = make([]byte, 5, 5+l)
+		buf[0] = LP_ENCODING_32BIT_STR
+		binary.LittleEndian.PutUint32(buf[1:], uint32(l))
+	}
+	return append(buf, ele...)
+}
+
+// backlen要几个字节
+func lpBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+/*
+编码backlen，最左边的字节是最高的7位，其它字节的最高位都是1，表示往左还有
+*/
+func lpEncodeBacklen(l int) []byte {
+	n := lpBacklenSize(l)
+	buf := make([]byte, n)
+	for i := 0; i < n; i++ {
+		buf[i] = byte(l>>(7*(n-1-i))) & 127
+		if i > 0 {
+			buf[i] |= 128
+		}
+	}
+	return buf
+}
+
+// 从p(backlen的最后一个字节)往前解码backlen
+func (lp *Listpack) decodeBacklen(p int) int {
+	val, shift := 0, 0
+	for {
+		val |= int(lp.buf[p]&127) << shift
+		if lp.buf[p]&128 == 0 {
+			break
+		}
+		shift += 7
+		p--
+	}
+	return val
+}
+
+// encoding+data的长度
+func (lp *Listpack) currentEncodedSize(p int) int {
+	b := lp.buf[p]
+	switch {
+	case b&0x80 == 0:
+		return 1
+	case b&0xC0 == LP_ENCODING_6BIT_STR:
+		return 1 + int(b&0x3F)
+	case b&0xE0 == LP_ENCODING_13BIT_INT:
+		return 2
+	case b&0xF0 == LP_ENCODING_12BIT_STR:
+		return 2 + (int(b&0x0F)<<8 | int(lp.buf[p+1]))
+	case b == LP_ENCODING_32BIT_STR:
+		return 5 + int(binary.LittleEndian.Uint32(lp.buf[p+1:]))
+	case b == LP_ENCODING_16BIT_INT:
+		return 3
+	case b == LP_ENCODING_24BIT_INT:
+		return 4
+	case b == LP_ENCODING_32BIT_INT:
+		return 5
+	case b == LP_ENCODING_64BIT_INT:
+		return 9
+	}
+	panic("listpack: invalid encoding")
+}
+
+// 整个entry的长度，包括backlen
+func (lp *Listpack) entrySize(p int) int {
+	l := lp.currentEncodedSize(p)
+	return l + lpBacklenSize(l)
+}
+
+func (lp *Listpack) First() int {
+	if lp.buf[LP_HDR_SIZE] == LP_EOF {
+		return -1
+	}
+	return LP_HDR_SIZE
+}
+
+func (lp *Listpack) Last() int {
+	return lp.Prev(len(lp.buf) - 1)
+}
+
+func (lp *Listpack) Next(p int) int {
+	p += lp.entrySize(p)
+	if lp.buf[p] == LP_EOF {
+		return -1
+	}
+	return p
+}
+
+func (lp *Listpack) Prev(p int) int {
+	if p == LP_HDR_SIZE {
+		return -1
+	}
+	l := lp.decodeBacklen(p - 1)
+	return p - l - lpBacklenSize(l)
+}
+
+/*
+取出p处的元素，整数编码的同时返回整数值
+*/
+func (lp *Listpack) GetValue(p int) (str string, ival int64, isInt bool) {
+	b := lp.buf[p]
+	switch {
+	case b&0x80 == 0:
+		return "", int64(b & 0x7F), true
+	case b&0xC0 == LP_ENCODING_6BIT_STR:
+		l := int(b & 0x3F)
+		return string(lp.buf[p+1 : p+1+l]), 0, false
+	case b&0xE0 == LP_ENCODING_13BIT_INT:
+		uv := uint64(b&0x1F)<<8 | uint64(lp.buf[p+1])
+		if uv >= 1<<12 { // 负数
+			return "", int64(uv) - (1 << 13), true
+		}
+		return "", int64(uv), true
+	case b&0xF0 == LP_ENCODING_12BIT_STR:
+		l := int(b&0x0F)<<8 | int(lp.buf[p+1])
+		return string(lp.buf[p+2 : p+2+l]), 0, false
+	case b == LP_ENCODING_32BIT_STR:
+		l := int(binary.LittleEndian.Uint32(lp.buf[p+1:]))
+		return string(lp.buf[p+5 : p+5+l]), 0, false
+	case b == LP_ENCODING_16BIT_INT:
+		return "", int64(int16(binary.LittleEndian.Uint16(lp.buf[p+1:]))), true
+	case b == LP_ENCODING_24BIT_INT:
+		uv := uint32(lp.buf[p+1]) | uint32(lp.buf[p+2])<<8 | uint32(lp.buf[p+3])<<16
+		return "", int64(int32(uv<<8) >> 8), true
+	case b == LP_ENCODING_32BIT_INT:
+		return "", int64(int32(binary.LittleEndian.Uint32(lp.buf[p+1:]))), true
+	case b == LP_ENCODING_64BIT_INT:
+		return "", int64(binary.LittleEndian.Uint64(lp.buf[p+1:])), true
+	}
+	panic("listpack: invalid encoding")
+}
+
+// 取出p处的元素，整数也转成字符串
+func (lp *Listpack) Get(p int) string {
+	str, ival, isInt := lp.GetValue(p)
+	if isInt {
+		return strconv.FormatInt(ival, 10)
+	}
+	return str
+}
+
+/*
+在p的前面或者后面插入一个元素，p为-1表示插到最后
+返回新元素的偏移
+*/
+func (lp *Listpack) Insert(p int, ele string, where int) int {
+	if p == -1 {
+		p = len(lp.buf) - 1
+	} else if where == LP_AFTER {
+		p += lp.entrySize(p)
+	}
+	enc := lpEncode(ele)
+	entry := append(enc, lpEncodeBacklen(len(enc))...)
+	num := lp.Length()
+	lp.buf = append(lp.buf, entry...)
+	copy(lp.buf[p+len(entry):], lp.buf[p:len(lp.buf)-len(entry)])
+	copy(lp.buf[p:], entry)
+	lp.setTotalBytes(len(lp.buf))
+	lp.setNumElements(num + 1)
+	zmalloc(int64(len(entry)))
+	return p
+}
+
+func (lp *Listpack) Append(ele string) int {
+	return lp.Insert(-1, ele, LP_BEFORE)
+}
+
+func (lp *Listpack) Prepend(ele string) int {
+	return lp.Insert(lp.First(), ele, LP_BEFORE)
+}
+
+/*
+删除p处的元素，返回后面一个元素的偏移(也就是删除后的p)，没有了返回-1
+*/
+func (lp *Listpack) Delete(p int) int {
+	size := lp.entrySize(p)
+	num := lp.Length()
+	lp.buf = append(lp.buf[:p], lp.buf[p+size:]...)
+	lp.setTotalBytes(len(lp.buf))
+	lp.setNumElements(num - 1)
+	zfree(int64(size))
+	if lp.buf[p] == LP_EOF {
+		return -1
+	}
+	return p
+}
+
+// 替换p处的元素，返回新元素的偏移
+func (lp *Listpack) Replace(p int, ele string) int {
+	p = lp.Delete(p)
+	return lp.Insert(p, ele, LP_BEFORE)
+}
+
+/*
+按下标找元素，负数从后往前数，超出范围返回-1
+*/
+func (lp *Listpack) Seek(index int) int {
+	num := lp.Length()
+	if index < 0 {
+		index += num
+	}
+	if index < 0 || index >= num {
+		return -1
+	}
+	if index < num/2 {
+		p := lp.First()
+		for ; index > 0; index-- {
+			p = lp.Next(p)
+		}
+		return p
+	}
+	p := lp.Last()
+	for index = num - 1 - index; index > 0; index-- {
+		p = lp.Prev(p)
+	}
+	return p
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func lpElements(lp *Listpack) []string {
+	var eles []string
+	for p := lp.First(); p != -1; p = lp.Next(p) {
+		eles = append(eles, lp.Get(p))
+	}
+	return eles
+}
+
+func checkListpack(t *testing.T, lp *Listpack, want ...string) {
+	t.Helper()
+	if lp.Length() != len(want) {
+		t.Fatalf("length = %d, want %d", lp.Length(), len(want))
+	}
+	if lp.Bytes() != int(lp.buf[0])|int(lp.buf[1])<<8|int(lp.buf[2])<<16|int(lp.buf[3])<<24 {
+		t.Fatalf("total-bytes header does not match buffer length %d", lp.Bytes())
+	}
+	got := lpElements(lp)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("elements = %q, want %q", got, want)
+		}
+	}
+	// 从后往前靠backlen走，要和从前往后的一样
+	i := len(want) - 1
+	for p := lp.Last(); p != -1; p = lp.Prev(p) {
+		if lp.Get(p) != want[i] {
+			t.Fatalf("reverse element %d = %q, want %q", i, lp.Get(p), want[i])
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("reverse iteration stopped at %d", i)
+	}
+}
+
+func TestListpackEncoding(t *testing.T) {
+	eles := []string{
+		"0", "127", "128", "-1", "4095", "-4096", "4096", "-4097",
+		"32767", "-32768", "32768", "8388607", "-8388608", "8388608",
+		"2147483647", "-2147483648", "2147483648",
+		"9223372036854775807", "-9223372036854775808",
+		"", "a", "012", "+1", "-0", "1.5", "99999999999999999999",
+		strings.Repeat("x", 63), strings.Repeat("x", 64),
+		strings.Repeat("y", 4095), strings.Repeat("y", 4096),
+		strings.Repeat("z", 20000),
+	}
+	lp := lpNew()
+	for _, ele := range eles {
+		lp.Append(ele)
+	}
+	checkListpack(t, lp, eles...)
+
+	for p, i := lp.First(), 0; p != -1; p, i = lp.Next(p), i+1 {
+		_, ival, isInt := lp.GetValue(p)
+		v, err := strconv.ParseInt(eles[i], 10, 64)
+		canonical := err == nil && strconv.FormatInt(v, 10) == eles[i]
+		if isInt != canonical || (isInt && ival != v) {
+			t.Fatalf("%q: isInt = %v ival = %d", eles[i], isInt, ival)
+		}
+	}
+	// 小整数只占一个字节，加上backlen一共两个
+	small := lpNew()
+	small.Append("100")
+	if small.Bytes() != LP_HDR_SIZE+2+1 {
+		t.Fatalf("7 bit uint entry takes %d bytes", small.Bytes()-LP_HDR_SIZE-1)
+	}
+}
+
+func TestListpackInsertDelete(t *testing.T) {
+	lp := lpNew()
+	checkListpack(t, lp)
+	if lp.First() != -1 || lp.Last() != -1 || lp.Seek(0) != -1 {
+		t.Fatal("empty listpack has elements")
+	}
+	lp.Append("b")
+	lp.Prepend("a")
+	lp.Append("d")
+	lp.Insert(lp.Seek(1), "c", LP_AFTER)
+	lp.Insert(lp.First(), "_", LP_BEFORE)
+	checkListpack(t, lp, "_", "a", "b", "c", "d")
+
+	if lp.Get(lp.Seek(-1)) != "d" || lp.Get(lp.Seek(2)) != "b" || lp.Seek(5) != -1 || lp.Seek(-6) != -1 {
+		t.Fatal("seek returned the wrong element")
+	}
+
+	p := lp.Delete(lp.First())
+	if lp.Get(p) != "a" {
+		t.Fatalf("delete returned %q, want the next element", lp.Get(p))
+	}
+	if lp.Delete(lp.Last()) != -1 {
+		t.Fatal("deleting the last element should return -1")
+	}
+	checkListpack(t, lp, "a", "b", "c")
+
+	lp.Replace(lp.Seek(1), strings.Repeat("B", 300))
+	lp.Replace(lp.Last(), "3")
+	checkListpack(t, lp, "a", strings.Repeat("B", 300), "3")
+
+	for lp.First() != -1 {
+		lp.Delete(lp.First())
+	}
+	checkListpack(t, lp)
+	if lp.Bytes() != LP_HDR_SIZE+1 {
+		t.Fatalf("empty listpack is %d bytes", lp.Bytes())
+	}
+}
+
+func TestListpackManyElements(t *testing.T) {
+	lp := lpNew()
+	n := LP_HDR_NUMELE_UNKNOWN + 5
+	for i := 0; i < n; i++ {
+		lp.Append(strconv.Itoa(i))
+	}
+	// 超过65535个之后头里记不下，要遍历才知道
+	if lp.Length() != n {
+		t.Fatalf("length = %d, want %d", lp.Length(), n)
+	}
+	for i := 0; i < 10; i++ {
+		lp.Delete(lp.First())
+	}
+	if lp.Length() != n-10 {
+		t.Fatalf("length = %d after deletes, want %d", lp.Length(), n-10)
+	}
+	if lp.Get(lp.First()) != "10" || lp.Get(lp.Last()) != strconv.Itoa(n-1) {
+		t.Fatal("wrong elements at the ends")
+	}
+}
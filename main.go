@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/fnv"
+	"go-redis/dict"
+	"go-redis/list"
+	"golang.org/x/sys/unix"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
 const (
@@ -17,53 +23,262 @@ const (
 )
 
 const (
-	GODIS_IO_BUF     int = 1024 * 12
-	GODIS_MAX_BULK   int = 1024 * 4
-	GODIS_MAX_INLINE int = 1024 * 4
+	GODIS_IO_BUF        int = 1024 * 12
+	GODIS_REPLY_CHUNK   int = 1024 * 16 // 回复缓冲区和链表里每一块的大小
+	GODIS_IOV_MAX       int = 1024      // 一次writev最多发多少块
+	GODIS_MAX_INLINE    int = 1024 * 4
+	GODIS_MBULK_BIG_ARG int = 1024 * 32   // 超过这么长的参数单独分配缓冲区
+	GODIS_MAX_MULTIBULK int = 1024 * 1024 // 一条命令最多多少个参数
+	GODIS_MIN_BULK_LEN  int = 1024 * 1024 // proto-max-bulk-len 不能比这个小
 )
 
 type CmdType = byte
 
+// 命令的标志位
+const (
+	CMD_WRITE    int = 1 << 0 // 会修改数据
+	CMD_READONLY int = 1 << 1 // 只读取数据
+	CMD_PUBSUB   int = 1 << 2 // 订阅模式下也能执行
+	CMD_NOSCRIPT int = 1 << 3 // 脚本里不能调用
+	CMD_DENYOOM  int = 1 << 4 // 可能会占用更多内存，超过maxmemory的时候拒绝执行
+)
+
+// 客户端的标志位
+const (
+	CLIENT_PUBSUB            int = 1 << 0  // 处于订阅模式
+	CLIENT_TRACKING          int = 1 << 1  // 开启了客户端缓存追踪
+	CLIENT_TRACKING_BCAST    int = 1 << 2  // 广播模式，按前缀追踪
+	CLIENT_TRACKING_OPTIN    int = 1 << 3  // 只追踪 CLIENT CACHING yes 之后读的key
+	CLIENT_TRACKING_OPTOUT   int = 1 << 4  // 不追踪 CLIENT CACHING no 之后读的key
+	CLIENT_TRACKING_CACHING  int = 1 << 5  // 收到了 CLIENT CACHING yes/no
+	CLIENT_TRACKING_NOLOOP   int = 1 << 6  // 自己修改的key不通知自己
+	CLIENT_MULTI             int = 1 << 7  // 处于事务中
+	CLIENT_DIRTY_CAS         int = 1 << 8  // 监视的key被修改了
+	CLIENT_DIRTY_EXEC        int = 1 << 9  // 事务入队时出错了
+	CLIENT_BLOCKED           int = 1 << 10 // 被阻塞命令挂起了
+	CLIENT_SCRIPT            int = 1 << 11 // 脚本用来执行命令的伪客户端
+	CLIENT_DENY_BLOCKING     int = 1 << 12 // 阻塞命令不能阻塞，直接返回(事务和脚本中)
+	CLIENT_CLOSE_AFTER_REPLY int = 1 << 13 // 回复发完就断开
+)
+
+const GODIS_VERSION = "7.0.0" // HELLO里报告的版本，客户端按这个判断支持哪些命令
+
+const (
+	WRONGTYPE_ERR = "-WRONGTYPE Operation against a key holding the wrong kind of value"
+	OOM_ERR       = "-OOM command not allowed when used memory > 'maxmemory'."
+	WRONGPASS_ERR = "-WRONGPASS invalid username-password pair or user is disabled."
+)
+
+const ACTIVE_REHASH_MS int64 = 1 // 每次ServerCron最多花多少毫秒做rehash
+
+// 字典和链表里放的都是对象
+type (
+	Dict  = dict.Dict[*Gobj, *Gobj]
+	Entry = dict.Entry[*Gobj, *Gobj]
+	List  = list.List[*Gobj]
+	Node  = list.Node[*Gobj]
+)
+
 type GodisDB struct {
 	data   *Dict
 	expire *Dict
 }
 
 type GodisServer struct {
-	fd      int
-	port    int
-	db      *GodisDB
-	clients map[int]*GodisClient
-	keLoop  *KeLoop
+	ipfd          []int    // 每个监听地址一个fd
+	bindaddr      []string // 监听的地址，前面有 - 的是可选的
+	tcpKeepalive  int      // 秒，0表示不开启
+	port          int
+	tcpBacklog    int
+	db            *GodisDB
+	commands      map[string]*GodisCommand
+	clients       map[int]*GodisClient
+	clientsIndex  map[int64]*GodisClient // id -> 客户端，按id找客户端用
+	nextClientId  int64
+	currentClient *GodisClient // 正在执行命令的客户端
+
+	unixsocket     string // unix socket的路径，为空表示不监听
+	unixsocketperm uint32 // unix socket文件的权限，0表示不修改
+	sofd           int    // unix socket的fd，没有的话是-1
+
+	clientsPendingWrite []*GodisClient // 有回复还没写的客户端，beforeSleep里统一写
+	keLoop              *KeLoop
+
+	trackingTable  map[string]map[int64]struct{}     // key -> 读过这个key的客户端id
+	prefixTable    map[string]map[int64]*GodisClient // 广播模式下 前缀 -> 客户端
+	pubsubChannels map[string]map[int64]*GodisClient // 频道 -> 订阅的客户端
+	pubsubPatterns map[string]map[int64]*GodisClient // 模式 -> 订阅的客户端
+	watchedKeys    map[string]map[int64]*GodisClient // key -> 监视它的客户端
+	requirepass    string                            // 为空表示不需要密码
+
+	protoMaxBulkLen      int64 // 一个参数最长多少字节
+	clientMaxQuerybufLen int64 // 客户端输入缓冲区的上限，超过了就断开
+
+	statStartTime         int64            // 启动时间，毫秒
+	statNumCommands       int64            // 一共执行了多少命令
+	statNumConnections    int64            // 一共接受了多少连接
+	statTotalErrorReplies int64            // 一共回复了多少错误
+	errorReplies          map[string]int64 // 错误码 -> 回复了多少次，INFO errorstats 用
+
+	blockingKeys     map[string][]*GodisClient // key -> 阻塞在这个key上的客户端，先来先服务
+	readyKeys        []*Gobj                   // 有阻塞客户端，并且被写入了数据的key
+	readyKeysSet     map[string]struct{}       // readyKeys去重
+	unblockedClients []*GodisClient            // 刚解除阻塞，还要处理剩下输入的客户端
+
+	lua *luaState // 脚本
+
+	maxmemory          int64               // 内存上限，0表示不限制
+	maxmemoryPolicy    int                 // 超过上限后的淘汰策略
+	maxmemorySamples   int                 // 每次淘汰抽样多少个key
+	lfuLogFactor       int                 // LFU计数器的增长因子
+	lfuDecayTime       int                 // LFU计数器多少分钟衰减一次
+	lruclock           uint32              // 缓存的LRU时钟，ServerCron更新
+	evictionPool       []evictionPoolEntry // 淘汰池
+	preCommandOOMState bool                // 执行命令之前内存是不是已经超了，脚本里的命令要用
+	statEvictedKeys    int64               // 淘汰了多少key
+	statPeakMemory     int64               // 内存用量的峰值
+	startupMemory      int64               // 启动完成时的内存用量
+
+	listMaxListpackSize    int  // quicklist每个节点的大小限制，负数表示字节数的档位
+	listCompressDepth      int  // quicklist两头各有几个节点不压缩，0表示都不压缩
+	zsetMaxListpackEntries int  // 有序集合元素不超过这么多的时候用listpack
+	zsetMaxListpackValue   int  // 有序集合member不超过这么长的时候用listpack
+	activeRehashing        bool // ServerCron里要不要主动rehash
+
+	notifyKeyspaceEvents int // 要发送哪些键空间通知
 }
 
 type GodisClient struct {
-	fd       int
-	db       *GodisDB
-	args     []*Gobj
-	reply    *List
-	sentLen  int
-	queryBuf []byte
-	queryLen int
-	cmdType  CmdType
-	bulkNum  int
-	bulkLen  int
+	id            int64
+	fd            int
+	db            *GodisDB
+	args          []*Gobj
+	cmd           *GodisCommand
+	flags         int
+	name          string     // CLIENT SETNAME 设置的名字
+	authenticated bool       // 设置了密码的时候，要AUTH之后才能执行命令
+	resp          int        // 回复用的协议版本，HELLO可以切换
+	buf           []byte     // 固定大小的回复缓冲区，小的回复都先放这里
+	bufpos        int        // buf里已经放了多少
+	reply         *ReplyList // buf放不下的回复接在这个链表后面
+	sentLen       int        // 第一块(buf或者链表的第一个节点)已经发出去了多少
+	queryBuf      []byte
+	queryLen      int // queryBuf里数据的长度
+	qbPos         int // [qbPos, queryLen) 是还没处理的数据
+	lineScanned   int // 从qbPos开始已经找过多少字节，没有找到\r\n
+	cmdType       CmdType
+	bulkNum       int
+	bulkLen       int // 当前参数的长度，-1表示还没读到 $长度 这一行
+
+	trackingRedirect int64               // 失效消息转发给哪个客户端，0表示不转发
+	trackingPrefixes map[string]struct{} // 广播模式下关注的前缀
+	pubsubChannels   map[string]struct{} // 订阅的频道
+	pubsubPatterns   map[string]struct{} // 订阅的模式
+	mstate           []multiCmd          // 事务中排队的命令
+	watchedKeys      []*Gobj             // 监视的key
+	bpop             blockingState       // 阻塞命令的状态
 }
 
 type CommandProc func(c *GodisClient)
 
+/*
+arity 为负数时表示参数个数至少为 -arity
+firstKey, lastKey, keyStep 描述了哪些参数是key，lastKey为负数表示从后往前数
+*/
 type GodisCommand struct {
-	name  string
-	proc  CommandProc
-	arity int
+	name     string
+	proc     CommandProc
+	arity    int
+	flags    int
+	firstKey int
+	lastKey  int
+	keyStep  int
 }
 
 var server GodisServer
 
 var cmdTable = []GodisCommand{
-	{"get", getCommand, 2},
-	{"set", setCommand, 3},
-	{"expire", expireCommand, 3},
+	{"get", getCommand, 2, CMD_READONLY, 1, 1, 1},
+	{"set", setCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+	{"expire", expireCommand, 3, CMD_WRITE, 1, 1, 1},
+	{"del", delCommand, -2, CMD_WRITE, 1, -1, 1},
+	{"lpush", lpushCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+	{"rpush", rpushCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+	{"lpop", lpopCommand, -2, CMD_WRITE, 1, 1, 1},
+	{"rpop", rpopCommand, -2, CMD_WRITE, 1, 1, 1},
+	{"llen", llenCommand, 2, CMD_READONLY, 1, 1, 1},
+	{"lrange", lrangeCommand, 4, CMD_READONLY, 1, 1, 1},
+	{"lmove", lmoveCommand, 5, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+	{"lmpop", lmpopCommand, -4, CMD_WRITE, 0, 0, 0},
+	{"blpop", blpopCommand, -3, CMD_WRITE, 1, -2, 1},
+	{"brpop", brpopCommand, -3, CMD_WRITE, 1, -2, 1},
+	{"blmove", blmoveCommand, 6, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+	{"blmpop", blmpopCommand, -5, CMD_WRITE, 0, 0, 0},
+	{"zadd", zaddCommand, -4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+	{"zrem", zremCommand, -3, CMD_WRITE, 1, 1, 1},
+	{"zcard", zcardCommand, 2, CMD_READONLY, 1, 1, 1},
+	{"zscore", zscoreCommand, 3, CMD_READONLY, 1, 1, 1},
+	{"zrange", zrangeCommand, -4, CMD_READONLY, 1, 1, 1},
+	{"zpopmin", zpopminCommand, -2, CMD_WRITE, 1, 1, 1},
+	{"zpopmax", zpopmaxCommand, -2, CMD_WRITE, 1, 1, 1},
+	{"zmpop", zmpopCommand, -4, CMD_WRITE, 0, 0, 0},
+	{"bzpopmin", bzpopminCommand, -3, CMD_WRITE, 1, -2, 1},
+	{"bzpopmax", bzpopmaxCommand, -3, CMD_WRITE, 1, -2, 1},
+	{"bzmpop", bzmpopCommand, -5, CMD_WRITE, 0, 0, 0},
+	{"client", clientCommand, -2, CMD_NOSCRIPT, 0, 0, 0},
+	{"hello", helloCommand, -1, CMD_NOSCRIPT, 0, 0, 0},
+	{"auth", authCommand, -2, CMD_NOSCRIPT, 0, 0, 0},
+	{"info", infoCommand, -1, 0, 0, 0, 0},
+	{"subscribe", subscribeCommand, -2, CMD_PUBSUB | CMD_NOSCRIPT, 0, 0, 0},
+	{"unsubscribe", unsubscribeCommand, -1, CMD_PUBSUB | CMD_NOSCRIPT, 0, 0, 0},
+	{"psubscribe", psubscribeCommand, -2, CMD_PUBSUB | CMD_NOSCRIPT, 0, 0, 0},
+	{"punsubscribe", punsubscribeCommand, -1, CMD_PUBSUB | CMD_NOSCRIPT, 0, 0, 0},
+	{"publish", publishCommand, 3, 0, 0, 0, 0},
+	{"ping", pingCommand, -1, CMD_PUBSUB, 0, 0, 0},
+	{"multi", multiCommand, 1, CMD_NOSCRIPT, 0, 0, 0},
+	{"exec", execCommand, 1, CMD_NOSCRIPT, 0, 0, 0},
+	{"discard", discardCommand, 1, CMD_NOSCRIPT, 0, 0, 0},
+	{"watch", watchCommand, -2, CMD_NOSCRIPT, 1, -1, 1},
+	{"unwatch", unwatchCommand, 1, CMD_NOSCRIPT, 0, 0, 0},
+	{"eval", evalCommand, -3, CMD_NOSCRIPT, 0, 0, 0},
+	{"evalsha", evalShaCommand, -3, CMD_NOSCRIPT, 0, 0, 0},
+	{"script", scriptCommand, -2, CMD_NOSCRIPT, 0, 0, 0},
+	{"memory", memoryCommand, -2, 0, 0, 0, 0},
+	{"object", objectCommand, -2, 0, 0, 0, 0},
+	{"debug", debugCommand, -2, CMD_NOSCRIPT, 0, 0, 0},
+}
+
+/*
+key被修改了(写入、过期、删除)之后调用
+1. 监视这个key的事务失效
+2. 通知追踪这个key的客户端
+*/
+func signalModifiedKey(key *Gobj) {
+	touchWatchedKey(key)
+	trackingInvalidateKey(key)
+}
+
+/*
+从db中删除key，连同过期时间一起删
+key不存在返回false
+*/
+func dbDelete(key *Gobj) bool {
+	// 删除的时候会减引用计数，key可能就是dict里的那个对象，先保住它
+	key.IncrRefCount()
+	defer key.DecrRefCount()
+	server.db.expire.Delete(key)
+	return server.db.data.Delete(key) == nil
+}
+
+/*
+删除一个已经过期的key，并发出通知
+*/
+func deleteExpiredKey(key *Gobj) {
+	key.IncrRefCount()
+	dbDelete(key)
+	notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key, 0)
+	signalModifiedKey(key)
+	key.DecrRefCount()
 }
 
 func expireIfNeeded(key *Gobj) {
@@ -75,79 +290,376 @@ func expireIfNeeded(key *Gobj) {
 	if when > GetMsTime() { // 不到过期时间
 		return
 	}
-	server.db.expire.Delete(key)
-	server.db.data.Delete(key)
+	deleteExpiredKey(key)
+}
+
+/*
+从db里拿value，顺便更新访问时间，给LRU/LFU淘汰用
+*/
+func lookupKey(key *Gobj) *Gobj {
+	val := server.db.data.Get(key)
+	if val != nil {
+		updateObjectAccess(val)
+	}
+	return val
+}
+
+func findKeyWrite(key *Gobj) *Gobj {
+	expireIfNeeded(key)
+	return lookupKey(key)
 }
 
 func findKeyRead(key *Gobj) *Gobj {
 	expireIfNeeded(key) // 检查key要不要过期
-	return server.db.data.Get(key)
+	val := lookupKey(key)
+	if val == nil {
+		notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key, 0)
+	}
+	return val
 }
 
 func getCommand(c *GodisClient) {
 	key := c.args[1]
 	val := findKeyRead(key)
 	if val == nil {
-		c.AddReplyStr("$-1\r\n")
+		c.AddReplyNull()
 	} else if val.Type != GSTR {
-		c.AddReplyStr("-ERR: worng type\r\n")
+		c.AddReplyError(WRONGTYPE_ERR)
 	} else {
-		strVal := val.StrVal()
-		c.AddReplyStr(fmt.Sprintf("$%d%v\r\n", len(strVal), strVal))
+		c.AddReplyBulk(val)
 	}
 }
 
 func setCommand(c *GodisClient) {
 	key := c.args[1]
-	val := c.args[2]
-	if val.Type != GSTR {
-		c.AddReplyStr("-ERR: wrong type\r\n")
+	if c.args[2].Type != GSTR {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
 	}
+	c.args[2] = tryObjectEncoding(c.args[2])
+	val := c.args[2]
 	server.db.data.Set(key, val)
 	server.db.expire.Delete(key)
-	c.AddReplyStr("+OK\r\n")
+	signalModifiedKey(key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "set", key, 0)
+	c.AddReplyStatus("OK")
 }
 
 func expireCommand(c *GodisClient) {
 	key := c.args[1]
-	val := c.args[2]
-	if val.Type != GSTR {
-		c.AddReplyStr("-ERR: wrong type\r\n")
+	seconds, ok := getLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	if findKeyWrite(key) == nil { // key不存在，不能留下一个没有数据的过期时间
+		c.AddReplyInt(0)
+		return
 	}
-	expire := GetMsTime() + (val.IntVal() * 1000) // 转成毫秒
+	expire := GetMsTime() + (seconds * 1000) // 转成毫秒
 	expireObj := CreateFromInt(expire)
 	server.db.expire.Set(key, expireObj)
 	expireObj.DecrRefCount()
-	c.AddReplyStr("+OK\r\n")
+	signalModifiedKey(key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key, 0)
+	c.AddReplyInt(1)
+}
+
+func delCommand(c *GodisClient) {
+	deleted := 0
+	for _, key := range c.args[1:] {
+		expireIfNeeded(key)
+		if dbDelete(key) {
+			signalModifiedKey(key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, 0)
+			deleted++
+		}
+	}
+	c.AddReplyInt(int64(deleted))
+}
+
+// 只有default用户，没有设置密码的时候什么密码都行
+func checkPassword(user, pass string) bool {
+	if user != "default" {
+		return false
+	}
+	return server.requirepass == "" || pass == server.requirepass
+}
+
+/*
+AUTH [username] password
+*/
+func authCommand(c *GodisClient) {
+	if len(c.args) > 3 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	user, pass := "default", c.args[1].StrVal()
+	if len(c.args) == 3 {
+		user, pass = c.args[1].StrVal(), c.args[2].StrVal()
+	} else if server.requirepass == "" {
+		c.AddReplyError("AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+		return
+	}
+	if !checkPassword(user, pass) {
+		c.AddReplyError(WRONGPASS_ERR)
+		return
+	}
+	c.authenticated = true
+	c.AddReplyStatus("OK")
+}
+
+// 客户端名字只能用可见的ASCII字符，不能有空格
+func validateClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+HELLO [protover [AUTH username password] [SETNAME clientname]]
+1. 切换协议版本，只支持2和3，不带版本就只回复信息
+2. 只有default用户，没有设置密码的时候密码随便填；没认证过又不带AUTH的话不能切换
+3. 用map回复服务器的信息，RESP2下是平铺的数组
+*/
+func helloCommand(c *GodisClient) {
+	ver := 0
+	nextArg := 1
+	if len(c.args) >= 2 {
+		v, err := strconv.ParseInt(c.args[1].StrVal(), 10, 64)
+		if err != nil {
+			c.AddReplyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if v < int64(RESP2) || v > int64(RESP3) {
+			c.AddReplyError("-NOPROTO unsupported protocol version")
+			return
+		}
+		ver = int(v)
+		nextArg++
+	}
+	name := c.name
+	for j := nextArg; j < len(c.args); j++ {
+		moreArgs := len(c.args) - 1 - j
+		opt := strings.ToLower(c.args[j].StrVal())
+		if opt == "auth" && moreArgs >= 2 {
+			if !checkPassword(c.args[j+1].StrVal(), c.args[j+2].StrVal()) {
+				c.AddReplyError(WRONGPASS_ERR)
+				return
+			}
+			c.authenticated = true
+			j += 2
+		} else if opt == "setname" && moreArgs >= 1 {
+			name = c.args[j+1].StrVal()
+			if !validateClientName(name) {
+				c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			j++
+		} else {
+			c.AddReplyErrorFormat("Syntax error in HELLO option '%s'", c.args[j].StrVal())
+			return
+		}
+	}
+	if !c.authenticated {
+		c.AddReplyError("-NOAUTH HELLO must be called with the client already authenticated, otherwise the " +
+			"HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+	c.name = name
+	if ver != 0 {
+		c.resp = ver
+	}
+
+	c.AddReplyMapLen(7)
+	c.AddReplyBulkString("server")
+	c.AddReplyBulkString("redis")
+	c.AddReplyBulkString("version")
+	c.AddReplyBulkString(GODIS_VERSION)
+	c.AddReplyBulkString("proto")
+	c.AddReplyInt(int64(c.resp))
+	c.AddReplyBulkString("id")
+	c.AddReplyInt(c.id)
+	c.AddReplyBulkString("mode")
+	c.AddReplyBulkString("standalone")
+	c.AddReplyBulkString("role")
+	c.AddReplyBulkString("master")
+	c.AddReplyBulkString("modules")
+	c.AddReplyArrayLen(0)
+}
+
+/*
+RESP2订阅模式下要按消息的格式回复，不然客户端分不清
+*/
+func pingCommand(c *GodisClient) {
+	if len(c.args) > 2 {
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+	if c.flags&CLIENT_PUBSUB != 0 && c.resp == RESP2 {
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulkString("pong")
+		if len(c.args) == 1 {
+			c.AddReplyBulkString("")
+		} else {
+			c.AddReplyBulk(c.args[1])
+		}
+	} else if len(c.args) == 1 {
+		c.AddReplyStatus("PONG")
+	} else {
+		c.AddReplyBulk(c.args[1])
+	}
+}
+
+/*
+CLIENT 命令，根据子命令分发
+*/
+func clientCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "id" && len(c.args) == 2:
+		c.AddReplyInt(c.id)
+	case sub == "tracking" && len(c.args) >= 3:
+		clientTrackingCommand(c)
+	case sub == "caching" && len(c.args) == 3:
+		clientCachingCommand(c)
+	case sub == "getredir" && len(c.args) == 2:
+		clientGetRedirCommand(c)
+	case sub == "setname" && len(c.args) == 3:
+		if !validateClientName(c.args[2].StrVal()) {
+			c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = c.args[2].StrVal()
+		c.AddReplyStatus("OK")
+	case sub == "getname" && len(c.args) == 2:
+		if c.name == "" {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyBulkString(c.name)
+		}
+	default:
+		c.AddReplySubcommandSyntaxError()
+	}
+}
+
+/*
+把命令表放到map里，查找的时候不用遍历
+*/
+func populateCommandTable() {
+	server.commands = make(map[string]*GodisCommand, len(cmdTable))
+	for i := range cmdTable {
+		server.commands[cmdTable[i].name] = &cmdTable[i]
+	}
 }
 
 /*
 查找命令
 */
 func lookupCommand(cmdStr string) *GodisCommand {
-	cmdLower := strings.ToLower(cmdStr)
-	for _, c := range cmdTable {
-		if c.name == cmdLower {
-			return &c
-		}
+	return server.commands[strings.ToLower(cmdStr)]
+}
+
+/*
+根据命令的key描述，拿到参数中的所有key
+*/
+func getKeysFromCommand(cmd *GodisCommand, args []*Gobj) []*Gobj {
+	if cmd.firstKey == 0 {
+		return nil
 	}
-	return nil
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys []*Gobj
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
 }
 
-func (c *GodisClient) AddReply(o *Gobj) {
-	c.reply.Append(o)
-	o.IncrRefCount()
-	server.keLoop.AddFileEvent(c.fd, KE_WRITABLE, SendReplyToClient, c) // 将reply注册为一个写事件。
+/*
+根据id找到客户端
+*/
+func lookupClientByID(id int64) *GodisClient {
+	return server.clientsIndex[id]
+}
+
+func (c *GodisClient) hasPendingReplies() bool {
+	return c.bufpos > 0 || c.reply.Length() > 0
 }
 
+/*
+客户端要开始有回复了，放进clientsPendingWrite，等beforeSleep的时候直接写
+已经有回复在等着的话，要么已经在里面了，要么注册了写事件，不用再放
+脚本的伪客户端没有连接，回复留给脚本去读
+*/
+func (c *GodisClient) prepareClientToWrite() {
+	if c.flags&CLIENT_SCRIPT != 0 || c.hasPendingReplies() {
+		return
+	}
+	server.clientsPendingWrite = append(server.clientsPendingWrite, c)
+}
+
+/*
+添加回复
+1. 链表是空的就先往buf里放，放不下的部分接到链表后面；链表不空就只能往链表放，不然顺序就乱了
+2. 链表最后一块还有地方就先填满它，剩下的新建一块，至少 GODIS_REPLY_CHUNK 那么大
+*/
 func (c *GodisClient) AddReplyStr(str string) {
-	object := CreateObject(GSTR, str)
-	c.AddReply(object)
-	object.DecrRefCount() // 这里要减下去，因为AddReply会加一
+	c.prepareClientToWrite()
+	if c.reply.Length() == 0 {
+		n := copy(c.buf[c.bufpos:], str)
+		c.bufpos += n
+		str = str[n:]
+	}
+	if len(str) == 0 {
+		return
+	}
+	if tail := c.reply.Last(); tail != nil {
+		n := cap(tail.Val) - len(tail.Val)
+		if n > len(str) {
+			n = len(str)
+		}
+		tail.Val = append(tail.Val, str[:n]...)
+		str = str[n:]
+	}
+	if len(str) > 0 {
+		size := GODIS_REPLY_CHUNK
+		if len(str) > size {
+			size = len(str)
+		}
+		c.reply.Append(append(make([]byte, 0, size), str...))
+	}
+}
+
+/*
+执行命令
+1. 调用命令的实现
+2. 如果是只读命令，并且客户端开启了追踪，记住读过的key
+*/
+func call(c *GodisClient) {
+	prev := server.currentClient
+	server.currentClient = c
+	c.cmd.proc(c)
+	server.statNumCommands++
+	if c.cmd.flags&CMD_READONLY != 0 && c.flags&CLIENT_TRACKING != 0 && c.flags&CLIENT_TRACKING_BCAST == 0 {
+		trackingRememberKeys(c)
+	}
+	server.currentClient = prev
 }
 
 /*
 先拿到命令是啥
+1. 检查参数个数，事务中出错的话，整个事务都不执行了
+2. 设置了密码的话，没认证过只能执行 AUTH 和 HELLO
+3. 脚本跑太久的时候，只能执行 SCRIPT KILL
+4. 设置了maxmemory的话，先淘汰key，淘汰不动了就拒绝会占用内存的命令
+5. 订阅模式下只能执行订阅相关的命令
+6. 事务中的命令先入队
 */
 func ProcessCommand(c *GodisClient) {
 	cmdStr := c.args[0].StrVal()
@@ -158,28 +670,93 @@ func ProcessCommand(c *GodisClient) {
 	}
 	command := lookupCommand(cmdStr)
 	if command == nil {
-		c.AddReplyStr("-ERR: unknpwn command")
+		flagTransaction(c)
+		var args strings.Builder
+		for _, arg := range c.args[1:] {
+			fmt.Fprintf(&args, "'%.128s' ", arg.StrVal())
+		}
+		c.AddReplyErrorFormat("unknown command '%.128s', with args beginning with: %s", cmdStr, args.String())
 		resetClient(c)
 		return
 	}
-	command.proc(c)
+	c.cmd = command
+	if (command.arity > 0 && len(c.args) != command.arity) || len(c.args) < -command.arity {
+		flagTransaction(c)
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", command.name)
+		resetClient(c)
+		return
+	}
+	if !c.authenticated && command.name != "auth" && command.name != "hello" {
+		flagTransaction(c)
+		c.AddReplyError("-NOAUTH Authentication required.")
+		resetClient(c)
+		return
+	}
+	if server.lua.timedOut && !(command.name == "script" && strings.ToLower(c.args[1].StrVal()) == "kill") {
+		flagTransaction(c)
+		c.AddReplyError("-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+		resetClient(c)
+		return
+	}
+	if server.maxmemory > 0 {
+		server.preCommandOOMState = performEvictions() == EVICT_FAIL
+		if server.preCommandOOMState && isDenyOOMCommand(c) {
+			flagTransaction(c)
+			c.AddReplyError(OOM_ERR)
+			resetClient(c)
+			return
+		}
+	}
+	if c.flags&CLIENT_PUBSUB != 0 && c.resp == RESP2 && command.flags&CMD_PUBSUB == 0 { // RESP3的推送消息和普通回复分得开
+		c.AddReplyErrorFormat("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", command.name)
+		resetClient(c)
+		return
+	}
+	if c.flags&CLIENT_MULTI != 0 && !isMultiControlCommand(command) {
+		queueMultiCommand(c)
+		c.AddReplyStatus("QUEUED")
+		resetClient(c)
+		return
+	}
+	call(c)
 	resetClient(c)
+	if len(server.readyKeys) > 0 {
+		handleClientsBlockedOnKeys()
+	}
+}
+
+// EXEC的话，事务里有一条会占内存就算
+func isDenyOOMCommand(c *GodisClient) bool {
+	if c.cmd.flags&CMD_DENYOOM != 0 {
+		return true
+	}
+	if c.cmd.name == "exec" {
+		for _, mc := range c.mstate {
+			if mc.cmd.flags&CMD_DENYOOM != 0 {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // 释放 args refCount -1
 func freeArgs(client *GodisClient) {
 	// 从头节点一个一个删掉
 	for _, arg := range client.args {
-		arg.DecrRefCount()
+		if arg != nil { // 命令只读了一半就断开的话，后面的参数还是空的
+			arg.DecrRefCount()
+		}
 	}
+	client.args = nil
 }
 
 func freeReplyList(client *GodisClient) {
-	for client.reply.length != 0 {
-		n := client.reply.head
-		client.reply.DelNode(n)
-		n.Val.DecrRefCount()
+	for client.reply.Length() != 0 {
+		client.reply.DelNode(client.reply.First())
 	}
+	client.bufpos = 0
+	client.sentLen = 0
 }
 
 /*
@@ -191,7 +768,15 @@ func freeReplyList(client *GodisClient) {
 */
 func freeClient(client *GodisClient) {
 	freeArgs(client)
+	disableTracking(client)
+	pubsubUnsubscribeAllChannels(client)
+	pubsubUnsubscribeAllPatterns(client)
+	discardTransaction(client)
+	if client.flags&CLIENT_BLOCKED != 0 {
+		unblockClient(client)
+	}
 	delete(server.clients, client.fd)
+	delete(server.clientsIndex, client.id)
 	server.keLoop.RemoveFileEvent(client.fd, KE_READABLE)
 	server.keLoop.RemoveFileEvent(client.fd, KE_WRITABLE)
 	freeReplyList(client)
@@ -200,44 +785,110 @@ func freeClient(client *GodisClient) {
 
 func resetClient(client *GodisClient) {
 	freeArgs(client)
+	// CLIENT CACHING 只对下一条命令生效，事务中要留到EXEC
+	if client.flags&CLIENT_MULTI == 0 && (client.cmd == nil || client.cmd.name != "client") {
+		client.flags &^= CLIENT_TRACKING_CACHING
+	}
+	client.cmd = nil
 	client.cmdType = COMMAND_UNKNOWN
 	client.bulkNum = 0
-	client.bulkLen = 0
+	client.bulkLen = -1
 }
 
-// 找到结束的位置
-// 如果没找到，就返回错误喽
+/*
+找到从qbPos开始的这一行的\n的下标，还没收完整返回-1
+1. 上次已经找过的部分不再重复找，只找新读进来的数据
+2. 一行太长还没结束的话就是错误的请求
+*/
 func (client *GodisClient) findLineInQuery() (int, error) {
-	index := strings.Index(string(client.queryBuf[:client.queryLen]), "\r\n")
-	if index < 0 && client.queryLen > GODIS_MAX_INLINE {
-		return index, errors.New("too long inline cmd")
+	start := client.qbPos + client.lineScanned
+	index := bytes.IndexByte(client.queryBuf[start:client.queryLen], '\n')
+	if index >= 0 {
+		client.lineScanned = 0
+		return start + index, nil
+	}
+	client.lineScanned = client.queryLen - client.qbPos
+	if client.lineScanned > GODIS_MAX_INLINE {
+		return -1, errors.New("too big inline request")
+	}
+	return -1, nil
+}
+
+// bulk格式的每一行都要以\r\n结束，返回\r的下标
+func (client *GodisClient) findCRLFInQuery() (int, error) {
+	index, err := client.findLineInQuery()
+	if index < 0 {
+		return index, err
+	}
+	if index == client.qbPos || client.queryBuf[index-1] != '\r' {
+		return -1, errors.New("expect CRLF for line end")
+	}
+	return index - 1, nil
+}
+
+// 解析请求里的长度，直接在字节上算，不用先转成字符串
+func parseQueryLength(b []byte) (int, error) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, errors.New("invalid length")
+	}
+	neg := b[0] == '-'
+	if neg {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, errors.New("invalid length")
+		}
+	}
+	n := 0
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return 0, errors.New("invalid length")
+		}
+		n = n*10 + int(ch-'0')
+	}
+	if neg {
+		n = -n
 	}
-	return index, nil
+	return n, nil
 }
 
 /*
-拿到bulk的数量
+拿到 *数量 或者 $长度，index是这一行的\r，读完跳过这一行
 */
-func (client *GodisClient) getNumInQuery(s, e int) (int, error) {
-	num, err := strconv.Atoi(string(client.queryBuf[s:e]))
-	client.queryBuf = client.queryBuf[e+2:]
-	client.queryLen -= e + 2
+func (client *GodisClient) getNumInQuery(index int) (int, error) {
+	num, err := parseQueryLength(client.queryBuf[client.qbPos+1 : index])
+	client.qbPos = index + 2
 	return num, err
 }
 
+// 把还没处理的数据挪到缓冲区最前面
+func (client *GodisClient) compactQueryBuf() {
+	if client.qbPos == 0 {
+		return
+	}
+	client.queryLen = copy(client.queryBuf, client.queryBuf[client.qbPos:client.queryLen])
+	client.qbPos = 0
+}
+
 /*
-处理inline格式的请求
-从请求中把一个个参数拿出来就行了。
+处理inline格式的请求，telnet、nc直接敲命令用的就是这种
+1. 一行以\n结束，前面的\r可有可无
+2. 按redis-cli的规则拆参数，支持引号和转义，空行就是没有参数
 */
 func handleInlineBuf(client *GodisClient) (bool, error) {
 	index, err := client.findLineInQuery()
 	if index < 0 {
 		return false, err
 	}
+	end := index
+	if end > client.qbPos && client.queryBuf[end-1] == '\r' {
+		end--
+	}
 
-	subs := strings.Split(string(client.queryBuf[:index]), " ") // inline是用空格分开的
-	client.queryBuf = client.queryBuf[index+2:]                 // 往后走，除掉/r/n
-	client.queryLen -= index + 2
+	subs, err := splitArgs(client.queryBuf[client.qbPos:end])
+	client.qbPos = index + 1 // 往后走，除掉\n
+	if err != nil {
+		return false, err
+	}
 	client.args = make([]*Gobj, len(subs))
 	for i, sub := range subs {
 		client.args[i] = CreateObject(GSTR, sub)
@@ -248,23 +899,28 @@ func handleInlineBuf(client *GodisClient) (bool, error) {
 
 /*
 处理bulk格式的请求
+1. 先读 *参数个数，再一个个读 $长度 和参数本身，没读完的话下次接着读
+2. 大参数放在一块单独的、正好放得下的缓冲区的开头，读完之后直接拿这块内存做字符串，不用再拷贝一次
 */
 func handleBulkBuf(client *GodisClient) (bool, error) {
 	if client.bulkNum == 0 {
-		index, err := client.findLineInQuery()
+		index, err := client.findCRLFInQuery()
 		if index < 0 {
 			return false, err
 		}
 
-		if client.queryBuf[0] != '$' {
-			return false, errors.New("except $ for bulk length") // $符号后面是bulk的长度
+		if client.queryBuf[client.qbPos] != '*' {
+			return false, errors.New("except * for bulk num") // *符号后面是bulk的数量
 		}
 
-		bnum, err := client.getNumInQuery(1, index)
+		bnum, err := client.getNumInQuery(index)
 		if err != nil {
 			return false, err
 		}
-		if bnum == 0 {
+		if bnum > GODIS_MAX_MULTIBULK {
+			return false, errors.New("invalid multibulk length")
+		}
+		if bnum <= 0 {
 			return true, nil
 		}
 		client.bulkNum = bnum
@@ -272,36 +928,52 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 	}
 	// 读取每一个bulk
 	for client.bulkNum > 0 {
-		if client.bulkLen == 0 {
-			index, err := client.findLineInQuery()
+		if client.bulkLen < 0 {
+			index, err := client.findCRLFInQuery()
 			if index < 0 {
 				return false, err
 			}
 
-			if client.queryBuf[0] != '$' {
+			if client.queryBuf[client.qbPos] != '$' {
 				return false, errors.New("expect $ for bulk length")
 			}
 
-			blen, err := client.getNumInQuery(1, index)
-			if err != nil || blen == 0 {
+			blen, err := client.getNumInQuery(index)
+			if err != nil {
 				return false, err
 			}
-			if blen > GODIS_MAX_BULK {
-				return false, errors.New("too big bulk")
+			if blen < 0 || int64(blen) > server.protoMaxBulkLen {
+				return false, errors.New("invalid bulk length")
 			}
 			client.bulkLen = blen
+			if blen >= GODIS_MBULK_BIG_ARG {
+				client.compactQueryBuf()
+				if len(client.queryBuf) < blen+2 {
+					buf := make([]byte, blen+2)
+					client.queryLen = copy(buf, client.queryBuf[:client.queryLen])
+					client.queryBuf = buf
+				}
+			}
 		}
-		if client.queryLen < client.bulkLen+2 {
+		if client.queryLen-client.qbPos < client.bulkLen+2 {
 			return false, nil
 		}
-		index := client.bulkLen
-		if client.queryBuf[index] != '\r' || client.queryBuf[index+1] != '\n' {
+		end := client.qbPos + client.bulkLen
+		if client.queryBuf[end] != '\r' || client.queryBuf[end+1] != '\n' {
 			return false, errors.New("expect CRLF for bulk end")
 		}
-		client.args[len(client.args)-client.bulkNum] = CreateObject(GSTR, string(client.queryBuf[:index]))
-		client.queryBuf = client.queryBuf[index+2:]
-		client.queryLen = 0
-		client.bulkLen = 0
+		var arg string
+		if client.qbPos == 0 && client.queryLen == client.bulkLen+2 && cap(client.queryBuf) == client.bulkLen+2 {
+			// 整块缓冲区正好就是这个参数，交给对象之后客户端不再用它
+			arg = unsafe.String(&client.queryBuf[0], client.bulkLen)
+			client.queryBuf = nil
+			client.queryLen = 0
+		} else {
+			arg = string(client.queryBuf[client.qbPos:end])
+			client.qbPos = end + 2
+		}
+		client.args[len(client.args)-client.bulkNum] = CreateObject(GSTR, arg)
+		client.bulkLen = -1
 		client.bulkNum -= 1
 	}
 	return true, nil
@@ -310,12 +982,17 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 /*
 处理queryBuf
 1. 判断使用的是哪种命令
-2. 根据两种情况进行处理。
+2. 根据两种情况进行处理，一次读进来的数据里可能有很多条命令，一条条处理完
+3. QUIT之类的命令会把客户端释放掉，释放了就不能再往下处理了
+4. 数据都处理完了就从头开始用缓冲区，没处理完的留着，等缓冲区不够用的时候再挪
 */
 func ProcessQueryBuf(client *GodisClient) error {
-	for client.queryLen > 0 {
+	for client.qbPos < client.queryLen {
+		if client.flags&(CLIENT_BLOCKED|CLIENT_CLOSE_AFTER_REPLY) != 0 { // 阻塞或者要断开的时候不处理后面的命令
+			break
+		}
 		if client.cmdType == COMMAND_UNKNOWN {
-			if client.queryBuf[0] == '*' {
+			if client.queryBuf[client.qbPos] == '*' {
 				client.cmdType = COMMAND_BULK
 			} else {
 				client.cmdType = COMMAND_INLINE
@@ -333,83 +1010,164 @@ func ProcessQueryBuf(client *GodisClient) error {
 		if err != nil {
 			return err
 		}
-		if ok {
-			if len(client.args) == 0 {
-				resetClient(client)
-			} else {
-				ProcessCommand(client)
-			}
-		} else {
+		if !ok {
 			break
 		}
+		if len(client.args) == 0 {
+			resetClient(client)
+		} else {
+			ProcessCommand(client)
+			if server.clients[client.fd] != client {
+				return nil
+			}
+		}
+	}
+	if client.qbPos == client.queryLen {
+		client.qbPos = 0
+		client.queryLen = 0
 	}
 	return nil
 }
 
 /*
 从client中读取请求
-1. 判断queryBuf剩余大小够不够 GODIS_MAX_BULK 如果不够，就扩容
-2.
+1. 一般每次读 GODIS_IO_BUF 个字节，正在读大参数的时候只读到这个参数结束为止
+2. 后面的空间不够了先把没处理的数据挪到前面，还不够再扩容
+3. socket是非阻塞的，读到EAGAIN说明其实没有数据，读到0个字节说明客户端断开了
+4. 没处理的数据超过了 client-query-buffer-limit 就断开，防止客户端一直发不完整的命令把内存撑爆
 */
 func ReadQueryFromClient(loop *KeLoop, fd int, extra interface{}) {
 	client := extra.(*GodisClient)
-	if len(client.queryBuf)-client.queryLen < GODIS_MAX_BULK {
-		client.queryBuf = append(client.queryBuf, make([]byte, GODIS_MAX_BULK)...)
+	readLen := GODIS_IO_BUF
+	if client.cmdType == COMMAND_BULK && client.bulkLen >= GODIS_MBULK_BIG_ARG {
+		if remaining := client.bulkLen + 2 - (client.queryLen - client.qbPos); remaining > 0 {
+			readLen = remaining
+		}
 	}
-	n, err := Read(fd, client.queryBuf[client.queryLen:])
-	if err != nil {
+	if len(client.queryBuf)-client.queryLen < readLen {
+		client.compactQueryBuf()
+	}
+	if len(client.queryBuf)-client.queryLen < readLen {
+		client.queryBuf = append(client.queryBuf[:client.queryLen], make([]byte, readLen)...)
+	}
+	n, err := Read(fd, client.queryBuf[client.queryLen:client.queryLen+readLen])
+	if err == unix.EAGAIN { // 其实还没有数据，等下次可读
+		return
+	} else if err != nil {
 		log.Printf("client %v read err: %v\n", fd, err)
 		freeClient(client)
 		return
+	} else if n == 0 {
+		log.Printf("client %v closed connection\n", fd)
+		freeClient(client)
+		return
 	}
 	client.queryLen += n
 	log.Printf("read %v bytes from client:%v\n", n, client.fd)
-	log.Printf("ReadRueryFromClient, queryBuf: %v\n", string(client.queryBuf))
-	err = ProcessQueryBuf(client)
-	if err != nil {
-		log.Printf("process query buff error: %v\n", err)
+	if int64(client.queryLen-client.qbPos) > server.clientMaxQuerybufLen {
+		log.Printf("closing client %v that reached max query buffer length: %v\n", client.fd, client.queryLen-client.qbPos)
 		freeClient(client)
 		return
 	}
+	if err = ProcessQueryBuf(client); err != nil {
+		setProtocolError(client, err)
+	}
 }
 
 /*
-发送回复到客户端
-1.reply是一个链表，遍历他然后网外发
-2. 先拿到值放到buf里
-3. 写入可能不能一次完成，因此使用sentLen来判断
-4. 从sentLen开始写，这里有可能会把之前残留的数据也写过去
-5. 如果buf里的被写完了，删掉这一条回复就ok
-6. 如果没写完，跳出循环，等待下一次事件被触发(再事件循环机制下，一次事件的触发，只能执行一次读写)
-7. 写入完成之后就删掉节点
+请求的格式不对，回复错误之后断开，后面收到的数据都不再处理
+读事件要摘掉，epoll是水平触发的，不摘的话客户端一直发数据就会一直被唤醒空转
 */
-func SendReplyToClient(loop *KeLoop, fd int, extra interface{}) {
-	client := extra.(*GodisClient)
-	log.Printf("SendReplyToClient, reply len:%v\n", client.reply.Length())
-	for client.reply.length > 0 {
-		rep := client.reply.First()
-		buf := []byte(rep.Val.StrVal())
-		bufLen := len(buf)
-		if client.sentLen < bufLen {
-			n, err := Write(fd, buf[client.sentLen:]) // 写入可能不是一次就能完成的，所以加sentLen来判断
-			if err != nil {
-				log.Printf("send reply err: %v\n", err)
-				freeClient(client)
-				return
-			}
+func setProtocolError(client *GodisClient, err error) {
+	log.Printf("process query buff error: %v\n", err)
+	client.AddReplyError("Protocol error: " + err.Error())
+	client.flags |= CLIENT_CLOSE_AFTER_REPLY
+	server.keLoop.RemoveFileEvent(client.fd, KE_READABLE)
+}
+
+/*
+把buf和reply链表一起用writev发出去，返回false表示出错了，客户端已经被释放
+1. buf在链表前面，sentLen是最前面那一块已经发出去了多少
+2. 一次最多发 GODIS_IOV_MAX 块，没发完的等下次
+3. 发完的节点从链表里删掉，buf发完了就从头开始用
+4. 都发完了，要断开的客户端就可以释放了
+*/
+func writeToClient(client *GodisClient) bool {
+	iov := make([][]byte, 0, 16)
+	if client.bufpos > 0 {
+		iov = append(iov, client.buf[client.sentLen:client.bufpos])
+	}
+	for node := client.reply.First(); node != nil && len(iov) < GODIS_IOV_MAX; node = node.Next() {
+		b := node.Val
+		if client.bufpos == 0 && node == client.reply.First() {
+			b = b[client.sentLen:]
+		}
+		if len(b) > 0 {
+			iov = append(iov, b)
+		}
+	}
+	n := 0
+	if len(iov) > 0 {
+		var err error
+		if n, err = Writev(client.fd, iov); err == unix.EAGAIN { // socket缓冲区满了，等可写了再发
+			n = 0
+		} else if err != nil {
+			log.Printf("send reply err: %v\n", err)
+			freeClient(client)
+			return false
+		}
+		log.Printf("send %v bytes to clients:%v\n", n, client.fd)
+	}
+	if client.bufpos > 0 {
+		if client.sentLen+n < client.bufpos {
 			client.sentLen += n
-			log.Printf("send %v bytes to clients:%v\n", n, client.fd)
-			if client.sentLen == bufLen {
-				client.reply.DelNode(rep)
-				rep.Val.DecrRefCount()
-				client.sentLen = 0
-			} else {
-				break
-			}
+			return true
 		}
+		n -= client.bufpos - client.sentLen
+		client.bufpos = 0
+		client.sentLen = 0
 	}
-	if client.reply.Length() == 0 {
+	for node := client.reply.First(); node != nil; node = client.reply.First() {
+		remaining := len(node.Val) - client.sentLen
+		if n < remaining {
+			client.sentLen += n
+			break
+		}
+		n -= remaining
 		client.sentLen = 0
+		client.reply.DelNode(node)
+	}
+	if !client.hasPendingReplies() && client.flags&CLIENT_CLOSE_AFTER_REPLY != 0 {
+		freeClient(client)
+		return false
+	}
+	return true
+}
+
+/*
+beforeSleep里把这一轮产生的回复直接写出去，大部分时候一次就写完了，不用注册写事件
+写不完(socket缓冲区满了)的才注册写事件，等可写了再接着写
+*/
+func handleClientsWithPendingWrites() {
+	for _, c := range server.clientsPendingWrite {
+		if server.clients[c.fd] != c { // 已经断开了
+			continue
+		}
+		if writeToClient(c) && c.hasPendingReplies() {
+			server.keLoop.AddFileEvent(c.fd, KE_WRITABLE, SendReplyToClient, c)
+		}
+	}
+	server.clientsPendingWrite = server.clientsPendingWrite[:0]
+}
+
+/*
+发送回复到客户端，只有beforeSleep里没写完的时候才会注册这个写事件
+都写完了就把写事件摘掉
+*/
+func SendReplyToClient(loop *KeLoop, fd int, extra interface{}) {
+	client := extra.(*GodisClient)
+	log.Printf("SendReplyToClient, reply len:%v\n", client.reply.Length())
+	if writeToClient(client) && !client.hasPendingReplies() {
 		loop.RemoveFileEvent(fd, KE_WRITABLE)
 	}
 }
@@ -421,13 +1179,77 @@ func StrEqual(a, b *Gobj) bool {
 	return a.StrVal() == b.StrVal()
 }
 
-func StrHash(key *Gobj) int64 {
+/*
+设置哈希种子
+配置了hash-seed就用它，方便复现；否则每次启动随机一个，外面的人猜不到key会落到哪个槽
+*/
+func initHashFunctionSeed(hexSeed string) error {
+	seed := make([]byte, 16)
+	if hexSeed != "" {
+		b, err := hex.DecodeString(hexSeed)
+		if err != nil || len(b) != len(seed) {
+			return errors.New("hash-seed must be 32 hex characters")
+		}
+		copy(seed, b)
+	} else if _, err := rand.Read(seed); err != nil {
+		return err
+	}
+	dict.SetHashFunctionSeed(seed)
+	return nil
+}
+
+func StrHash(key *Gobj) uint64 {
 	if key.Type != GSTR {
 		return 0
 	}
-	hash := fnv.New64()
-	hash.Write([]byte(key.StrVal()))
-	return int64(hash.Sum64())
+	return dict.GenHashFunction([]byte(key.StrVal()))
+}
+
+/*
+对象放进字典或者回复链表的时候加引用计数，并统计内存
+拿出来的时候反过来
+*/
+func dupObject(o *Gobj) *Gobj {
+	o.IncrRefCount()
+	zmalloc(objectSize(o))
+	return o
+}
+
+func releaseObject(o *Gobj) {
+	zfree(objectSize(o))
+	o.DecrRefCount()
+}
+
+// 数据库的主字典和过期字典
+var dbDictType = dict.DictType[*Gobj, *Gobj]{
+	HashFunc:      StrHash,
+	EqualFunc:     StrEqual,
+	KeyDup:        dupObject,
+	ValDup:        dupObject,
+	KeyDestructor: releaseObject,
+	ValDestructor: releaseObject,
+	Malloc:        zmalloc,
+	Free:          zfree,
+}
+
+/*
+回复链表里的每一块按容量统计内存，放进去的时候加，删掉的时候减
+*/
+func dupReplyBlock(b []byte) []byte {
+	zmalloc(int64(cap(b)))
+	return b
+}
+
+func releaseReplyBlock(b []byte) {
+	zfree(int64(cap(b)))
+}
+
+// 客户端的回复链表
+var replyListType = list.ListType[[]byte]{
+	ValDup:        dupReplyBlock,
+	ValDestructor: releaseReplyBlock,
+	Malloc:        zmalloc,
+	Free:          zfree,
 }
 
 /*
@@ -435,10 +1257,19 @@ func StrHash(key *Gobj) int64 {
 */
 func CreateClient(fd int) *GodisClient {
 	var client GodisClient
+	server.nextClientId++
+	client.id = server.nextClientId
 	client.fd = fd
 	client.db = server.db
 	client.queryBuf = make([]byte, GODIS_IO_BUF)
-	client.reply = ListCreate(ListType{EqualFunc: StrEqual})
+	client.bulkLen = -1
+	client.resp = RESP2
+	client.authenticated = server.requirepass == ""
+	client.buf = make([]byte, GODIS_REPLY_CHUNK)
+	client.reply = list.New(replyListType)
+	if fd >= 0 { // 脚本的伪客户端不能按id找到
+		server.clientsIndex[client.id] = &client
+	}
 	return &client
 }
 
@@ -449,27 +1280,86 @@ func CreateClient(fd int) *GodisClient {
 2. 创建 client
 3. 注册到 server.clients 这个map中
 4. 注册 fileEvent
+5. 一次可读可能有好几个连接在等，循环接到EAGAIN为止，最多接 MAX_ACCEPTS_PER_CALL 个，免得别的事件等太久
 */
 func AcceptHandler(loop *KeLoop, fd int, extra interface{}) {
-	cfd, err := Accept(fd)
-	if err != nil {
-		log.Printf("accept err: %v\n", err)
-		return
+	for i := 0; i < MAX_ACCEPTS_PER_CALL; i++ {
+		cfd, err := Accept(fd)
+		if err == unix.EAGAIN { // 等着的连接都接完了
+			return
+		} else if err != nil {
+			log.Printf("accept err: %v\n", err)
+			return
+		}
+		if fd != server.sofd { // unix socket没有这些TCP选项
+			if err = EnableTcpNoDelay(cfd); err != nil {
+				log.Printf("set TCP_NODELAY err: %v\n", err)
+			}
+			if server.tcpKeepalive > 0 {
+				if err = KeepAlive(cfd, server.tcpKeepalive); err != nil {
+					log.Printf("set keepalive err: %v\n", err)
+				}
+			}
+		}
+		client := CreateClient(cfd)
+		// 这里漏了，应该要检查最大连接数的
+		server.clients[cfd] = client
+		server.statNumConnections++
+		server.keLoop.AddFileEvent(cfd, KE_READABLE, ReadQueryFromClient, client)
+		log.Printf("accept client,fd: %v\n", cfd)
 	}
-	client := CreateClient(fd)
-	// 这里漏了，应该要检查最大连接数的
-	server.clients[cfd] = client
-	server.keLoop.AddFileEvent(cfd, KE_READABLE, ReadQueryFromClient, client)
-	log.Printf("accept client,fd: %v\n", cfd)
 }
 
 /*
 *
 定时任务，每100ms跑一次
-1. TODO
+1. 更新LRU时钟
+2. 主动清理过期的key
+3. 删了很多key之后，哈希表太空了就缩小
 */
 func ServerCron(loop *KeLoop, fd int, extra interface{}) {
+	server.lruclock = getLRUClock()
+	activeExpireCycle()
+	databasesCron()
+}
 
+/*
+db相关的定时任务
+1. 过期和删除的时候已经会缩容了，这里再兜底检查一遍
+2. 开了activerehashing的话，花一点时间推进rehash(字典只在读写的时候迁移一个槽，没人访问的字典会一直挂着两张表)
+*/
+func databasesCron() {
+	server.db.data.ShrinkIfNeeded()
+	server.db.expire.ShrinkIfNeeded()
+	if server.activeRehashing {
+		incrementallyRehash()
+	}
+}
+
+/*
+每次最多花 ACTIVE_REHASH_MS 毫秒，先主字典，再过期字典
+返回这一轮是否做了rehash
+*/
+func incrementallyRehash() bool {
+	if server.db.data.IsRehashing() {
+		server.db.data.RehashMilliseconds(ACTIVE_REHASH_MS)
+		return true
+	}
+	if server.db.expire.IsRehashing() {
+		server.db.expire.RehashMilliseconds(ACTIVE_REHASH_MS)
+		return true
+	}
+	return false
+}
+
+/*
+每次进入epoll等待之前调用
+1. 处理刚解除阻塞的客户端积攒下来的命令
+2. 把这一轮的回复写出去
+*/
+func beforeSleep(loop *KeLoop) {
+	processUnblockedClients()
+	handleClientsWithPendingWrites()
 }
 
 /*
@@ -478,21 +1368,116 @@ func ServerCron(loop *KeLoop, fd int, extra interface{}) {
 2. 创建clients 的map
 3. 设置db，db中有两个Dict，每个Dict有两个函数：哈希和equal。
 4. 创建事件循环
-5. 创建tcp server
+5. 在配置的每个地址上监听，配置了unixsocket的话再监听unix socket，port为0表示不监听TCP
 */
 func initServer(config *Config) error {
 	server.port = config.Port
+	server.bindaddr = config.Bind
+	server.tcpBacklog = config.TcpBacklog
+	server.tcpKeepalive = config.TcpKeepalive
+	server.unixsocket = config.Unixsocket
+	server.sofd = -1
+	populateCommandTable()
+	createSharedObjects()
 	server.clients = make(map[int]*GodisClient)
-	server.db = &GodisDB{
-		data:   DictCreate(DictType{HashFunc: StrHash, EqualFunc: StrEqual}),
-		expire: DictCreate(DictType{HashFunc: StrHash, EqualFunc: StrEqual}),
+	server.clientsIndex = make(map[int64]*GodisClient)
+	server.trackingTable = make(map[string]map[int64]struct{})
+	server.prefixTable = make(map[string]map[int64]*GodisClient)
+	server.pubsubChannels = make(map[string]map[int64]*GodisClient)
+	server.pubsubPatterns = make(map[string]map[int64]*GodisClient)
+	server.watchedKeys = make(map[string]map[int64]*GodisClient)
+	server.blockingKeys = make(map[string][]*GodisClient)
+	server.readyKeysSet = make(map[string]struct{})
+	server.errorReplies = make(map[string]int64)
+	server.lruclock = getLRUClock()
+	server.statStartTime = GetMsTime()
+	server.requirepass = config.Requirepass
+	if config.ProtoMaxBulkLen < int64(GODIS_MIN_BULK_LEN) {
+		return fmt.Errorf("proto-max-bulk-len must be at least %d", GODIS_MIN_BULK_LEN)
+	}
+	server.protoMaxBulkLen = config.ProtoMaxBulkLen
+	if config.ClientQueryBufferLimit < int64(GODIS_MIN_BULK_LEN) || config.ClientQueryBufferLimit < config.ProtoMaxBulkLen {
+		return fmt.Errorf("client-query-buffer-limit must be at least %d and not smaller than proto-max-bulk-len", GODIS_MIN_BULK_LEN)
+	}
+	if config.Unixsocketperm != "" {
+		perm, err := strconv.ParseUint(config.Unixsocketperm, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid unixsocketperm '%s'", config.Unixsocketperm)
+		}
+		server.unixsocketperm = uint32(perm)
 	}
+	server.clientMaxQuerybufLen = config.ClientQueryBufferLimit
 	var err error
+	if server.notifyKeyspaceEvents, err = keyspaceEventsStringToFlags(config.NotifyKeyspaceEvents); err != nil {
+		return err
+	}
+	server.maxmemory = config.Maxmemory
+	if server.maxmemoryPolicy, err = maxmemoryPolicyFromString(config.MaxmemoryPolicy); err != nil {
+		return err
+	}
+	if err = initHashFunctionSeed(config.HashSeed); err != nil {
+		return err
+	}
+	server.maxmemorySamples = config.MaxmemorySamples
+	server.lfuLogFactor = config.LfuLogFactor
+	server.lfuDecayTime = config.LfuDecayTime
+	server.listMaxListpackSize = config.ListMaxListpackSize
+	server.listCompressDepth = config.ListCompressDepth
+	server.zsetMaxListpackEntries = config.ZsetMaxListpackEntries
+	server.zsetMaxListpackValue = config.ZsetMaxListpackValue
+	server.activeRehashing = config.ActiveRehashing
+	server.db = &GodisDB{
+		data:   dict.New(dbDictType),
+		expire: dict.New(dbDictType),
+	}
+	scriptingInit(config.LuaTimeLimit)
+	server.startupMemory = zmallocUsedMemory()
 	if server.keLoop, err = KeLoopCreate(); err != nil {
 		return err
 	}
-	server.fd, err = TcpServer(server.port)
-	return err
+	if server.port != 0 {
+		if err = listenToPort(); err != nil {
+			return err
+		}
+	}
+	if server.unixsocket != "" {
+		if server.sofd, err = UnixServer(server.unixsocket, server.unixsocketperm, server.tcpBacklog); err != nil {
+			return fmt.Errorf("failed opening unix socket %s: %v", server.unixsocket, err)
+		}
+		log.Printf("listening on unix socket %s\n", server.unixsocket)
+	}
+	if len(server.ipfd) == 0 && server.sofd < 0 {
+		return errors.New("configured to not listen anywhere")
+	}
+	return nil
+}
+
+/*
+按bind配置在每个地址上监听
+1. 地址前面有 - 的是可选的，机器上没有这个地址或者不支持这种协议就跳过
+2. 其他的地址绑不上就启动失败，已经监听的也关掉
+*/
+func listenToPort() error {
+	for _, addr := range server.bindaddr {
+		optional := strings.HasPrefix(addr, "-")
+		addr = strings.TrimPrefix(addr, "-")
+		fd, err := TcpServer(addr, server.port, server.tcpBacklog)
+		if err != nil {
+			if optional && (errors.Is(err, unix.EADDRNOTAVAIL) || errors.Is(err, unix.EAFNOSUPPORT) ||
+				errors.Is(err, unix.EPROTONOSUPPORT) || errors.Is(err, unix.ESOCKTNOSUPPORT)) {
+				log.Printf("skip optional bind address %s: %v\n", addr, err)
+				continue
+			}
+			for _, fd := range server.ipfd {
+				Close(fd)
+			}
+			server.ipfd = nil
+			return fmt.Errorf("could not create server TCP listening socket %s:%d: %v", addr, server.port, err)
+		}
+		server.ipfd = append(server.ipfd, fd)
+		log.Printf("listening on %s:%d\n", addr, server.port)
+	}
+	return nil
 }
 
 /*
@@ -506,7 +1491,7 @@ func initServer(config *Config) error {
 func main() {
 	// 启动的时候指定 配置文件路径
 	var configPath string
-	if len(os.Args) <= 2 {
+	if len(os.Args) < 2 {
 		configPath = "/home/ymk/workspace/golang/go-redis/config.json"
 	} else {
 		configPath = os.Args[1]
@@ -519,8 +1504,14 @@ func main() {
 	if err != nil {
 		log.Panicf("init server error: %v\n", err)
 	}
-	server.keLoop.AddFileEvent(server.fd, KE_READABLE, AcceptHandler, nil) // 注册文件事件，开始接受连接
-	server.keLoop.AddTimeEvent(KE_NORMAL, 1000, ServerCron, nil)
+	for _, fd := range server.ipfd {
+		server.keLoop.AddFileEvent(fd, KE_READABLE, AcceptHandler, nil) // 注册文件事件，开始接受连接
+	}
+	if server.sofd >= 0 {
+		server.keLoop.AddFileEvent(server.sofd, KE_READABLE, AcceptHandler, nil)
+	}
+	server.keLoop.AddTimeEvent(KE_NORMAL, 100, ServerCron, nil)
+	server.keLoop.SetBeforeSleepProc(beforeSleep)
 	log.Printf("go-redis server started")
 	server.keLoop.KeMain()
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newParseClient() *GodisClient {
+	server.protoMaxBulkLen = int64(GODIS_MIN_BULK_LEN)
+	return &GodisClient{queryBuf: make([]byte, GODIS_IO_BUF), bulkLen: -1}
+}
+
+// 和ReadQueryFromClient一样往缓冲区后面追加数据，不够了先挪再扩容
+func feedQuery(c *GodisClient, data string) {
+	if len(c.queryBuf)-c.queryLen < len(data) {
+		c.compactQueryBuf()
+	}
+	if len(c.queryBuf)-c.queryLen < len(data) {
+		c.queryBuf = append(c.queryBuf[:c.queryLen], make([]byte, len(data))...)
+	}
+	c.queryLen += copy(c.queryBuf[c.queryLen:], data)
+}
+
+// 和ProcessQueryBuf一样一条条解析，只是不执行命令
+func parseQuery(c *GodisClient) ([][]string, error) {
+	var cmds [][]string
+	for c.qbPos < c.queryLen {
+		if c.cmdType == COMMAND_UNKNOWN {
+			if c.queryBuf[c.qbPos] == '*' {
+				c.cmdType = COMMAND_BULK
+			} else {
+				c.cmdType = COMMAND_INLINE
+			}
+		}
+		var ok bool
+		var err error
+		if c.cmdType == COMMAND_BULK {
+			ok, err = handleBulkBuf(c)
+		} else {
+			ok, err = handleInlineBuf(c)
+		}
+		if err != nil {
+			return cmds, err
+		}
+		if !ok {
+			break
+		}
+		var args []string
+		for _, arg := range c.args {
+			args = append(args, arg.StrVal())
+		}
+		cmds = append(cmds, args)
+		resetClient(c)
+	}
+	if c.qbPos == c.queryLen {
+		c.qbPos = 0
+		c.queryLen = 0
+	}
+	return cmds, nil
+}
+
+func checkCmds(t *testing.T, got [][]string, want ...[]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("parsed %q, want %q", got, want)
+	}
+	for i := range want {
+		if strings.Join(got[i], "\x00") != strings.Join(want[i], "\x00") {
+			t.Fatalf("command %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	c := newParseClient()
+	feedQuery(c, "*1\r\n$4\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n*0\r\nGET k\r\n")
+	cmds, err := parseQuery(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCmds(t, cmds, []string{"PING"}, []string{"SET", "k", ""}, nil, []string{"GET", "k"})
+	if c.qbPos != 0 || c.queryLen != 0 {
+		t.Fatalf("qbPos = %d queryLen = %d after everything was parsed", c.qbPos, c.queryLen)
+	}
+}
+
+func TestParseByteByByte(t *testing.T) {
+	c := newParseClient()
+	query := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\nhello\r\nabc\r\n*1\r\n$4\r\nPING\r\n"
+	var cmds [][]string
+	for i := 0; i < len(query); i++ {
+		feedQuery(c, query[i:i+1])
+		got, err := parseQuery(c)
+		if err != nil {
+			t.Fatalf("after %d bytes: %v", i+1, err)
+		}
+		cmds = append(cmds, got...)
+	}
+	checkCmds(t, cmds, []string{"SET", "key", "hello\r\nabc"}, []string{"PING"})
+}
+
+func TestParsePartialKeepsOffset(t *testing.T) {
+	c := newParseClient()
+	feedQuery(c, "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1")
+	cmds, err := parseQuery(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCmds(t, cmds, []string{"PING"})
+	if c.qbPos == 0 || c.bulkNum != 1 {
+		t.Fatalf("qbPos = %d bulkNum = %d, want the half read command kept", c.qbPos, c.bulkNum)
+	}
+	c.compactQueryBuf()
+	if c.qbPos != 0 || string(c.queryBuf[:c.queryLen]) != "$1" {
+		t.Fatalf("compact left %q at %d", c.queryBuf[:c.queryLen], c.qbPos)
+	}
+	feedQuery(c, "\r\nk\r\n")
+	cmds, err = parseQuery(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCmds(t, cmds, []string{"GET", "k"})
+}
+
+func TestParseBigArg(t *testing.T) {
+	c := newParseClient()
+	big := strings.Repeat("x", GODIS_MBULK_BIG_ARG*2)
+	feedQuery(c, "*2\r\n$3\r\nSET\r\n$"+itoa(len(big))+"\r\n")
+	if _, err := parseQuery(c); err != nil {
+		t.Fatal(err)
+	}
+	// 大参数的缓冲区要正好放得下参数和\r\n
+	if len(c.queryBuf) != len(big)+2 {
+		t.Fatalf("query buffer is %d bytes, want %d", len(c.queryBuf), len(big)+2)
+	}
+	for i := 0; i < len(big); i += 1000 {
+		end := i + 1000
+		if end > len(big) {
+			end = len(big)
+		}
+		feedQuery(c, big[i:end])
+	}
+	feedQuery(c, "\r\n")
+	cmds, err := parseQuery(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCmds(t, cmds, []string{"SET", big})
+	feedQuery(c, "*1\r\n$4\r\nPING\r\n")
+	cmds, err = parseQuery(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCmds(t, cmds, []string{"PING"})
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{
+		"*1\r\nfoo\r\n",
+		"*1\r\n$3\r\nfoox\r\n",
+		"*abc\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$" + itoa(GODIS_MIN_BULK_LEN+1) + "\r\n",
+		"*" + itoa(GODIS_MAX_MULTIBULK+1) + "\r\n",
+		strings.Repeat("a", GODIS_MAX_INLINE+1),
+	} {
+		c := newParseClient()
+		feedQuery(c, query)
+		if _, err := parseQuery(c); err == nil {
+			t.Errorf("%.20q: no error", query)
+		}
+	}
+}
+
+func itoa(n int) string {
+	return CreateFromInt(int64(n)).StrVal()
+}
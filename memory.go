@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+/*
+内存统计
+go有gc，拿不到某个对象到底占了多少内存，这里按数据结构的大小来估算
+1. Dict的entry和哈希表，在添加删除entry、扩容和rehash完成的时候统计
+2. List和quicklist的节点、ZSet的元素和listpack的字节，在插入删除的时候统计
+3. 列表和有序集合对象被释放的时候，把里面剩下的元素一起减掉
+MEMORY 命令用这些估算来报告每个key和整个实例的内存
+*/
+
+const (
+	PTR_SIZE            = int64(unsafe.Sizeof(uintptr(0)))
+	GOBJ_SIZE           = int64(unsafe.Sizeof(Gobj{}))
+	ENTRY_SIZE          = int64(unsafe.Sizeof(Entry{}))
+	NODE_SIZE           = int64(unsafe.Sizeof(Node{}))
+	REPLY_NODE_SIZE     = int64(unsafe.Sizeof(ReplyBlock{}))
+	LIST_SIZE           = int64(unsafe.Sizeof(List{}))
+	LISTPACK_SIZE       = int64(unsafe.Sizeof(Listpack{}))
+	QUICKLIST_SIZE      = int64(unsafe.Sizeof(Quicklist{}))
+	QUICKLIST_NODE_SIZE = int64(unsafe.Sizeof(quicklistNode{}))
+	ZSET_SIZE           = int64(unsafe.Sizeof(ZSet{})) + int64(unsafe.Sizeof(zskiplist{}))
+	ZSKIPLIST_NODE_SIZE = int64(unsafe.Sizeof(zskiplistNode{})) + int64(unsafe.Sizeof(zskiplistLevel{}))
+)
+
+var usedMemory int64 // 当前估算的内存用量
+
+func zmalloc(size int64) {
+	usedMemory += size
+	if usedMemory > server.statPeakMemory {
+		server.statPeakMemory = usedMemory
+	}
+}
+
+func zfree(size int64) {
+	usedMemory -= size
+}
+
+func zmallocUsedMemory() int64 {
+	return usedMemory
+}
+
+/*
+对象本身的大小，列表和有序集合里的元素由各自的数据结构统计
+*/
+func objectSize(o *Gobj) int64 {
+	size := GOBJ_SIZE
+	switch v := o.Val.(type) {
+	case string:
+		size += int64(len(v))
+	case *string:
+		size += int64(unsafe.Sizeof(v)) + int64(len(*v))
+	case int64:
+		size += 8
+	case *List:
+		size += LIST_SIZE
+	case *Listpack:
+		size += LISTPACK_SIZE
+	case *Quicklist:
+		size += QUICKLIST_SIZE
+	case *ZSet:
+		size += ZSET_SIZE
+	}
+	return size
+}
+
+// 有序集合的一个元素：跳表节点(平均层数不到1.5，按一层算)加上dict里的一项
+func zsetElementSize(ele string) int64 {
+	return ZSKIPLIST_NODE_SIZE + 2*int64(len(ele)) + 8
+}
+
+/*
+对象被释放了，里面还剩的元素也跟着释放
+*/
+func freeObjectContents(o *Gobj) {
+	switch v := o.Val.(type) {
+	case *List:
+		for n := v.First(); n != nil; n = n.Next() {
+			zfree(NODE_SIZE + objectSize(n.Val))
+		}
+	case *Listpack:
+		zfree(int64(v.Bytes()))
+	case *Quicklist:
+		for node := v.head; node != nil; node = node.next {
+			zfree(QUICKLIST_NODE_SIZE + node.bytes())
+		}
+	case *ZSet:
+		for ele := range v.dict {
+			zfree(zsetElementSize(ele))
+		}
+	}
+}
+
+const OBJ_COMPUTE_SIZE_DEF_SAMPLES int = 5 // MEMORY USAGE 默认抽样多少个元素
+
+/*
+算一个对象一共占了多少内存，列表和有序集合元素太多的话只抽样前samples个，再按平均值估算
+samples为0表示全部都算
+*/
+func objectComputeSize(o *Gobj, samples int) int64 {
+	size := objectSize(o)
+	switch v := o.Val.(type) {
+	case *Listpack:
+		size += int64(v.Bytes())
+	case *Quicklist:
+		var nodesize int64
+		node := v.head
+		sampled := 0
+		for ; node != nil && (samples == 0 || sampled < samples); node = node.next {
+			nodesize += QUICKLIST_NODE_SIZE + node.bytes()
+			sampled += node.count
+		}
+		if sampled > 0 {
+			size += nodesize / int64(sampled) * v.Count()
+		}
+	case *List:
+		var elesize int64
+		n := v.First()
+		sampled := 0
+		for ; n != nil && (samples == 0 || sampled < samples); n = n.Next() {
+			elesize += NODE_SIZE + objectSize(n.Val)
+			sampled++
+		}
+		if sampled > 0 {
+			size += elesize / int64(sampled) * int64(v.Length())
+		}
+	case *ZSet:
+		var elesize int64
+		n := v.First()
+		sampled := 0
+		for ; n != nil && (samples == 0 || sampled < samples); n = n.level[0].forward {
+			elesize += zsetElementSize(n.ele)
+			sampled++
+		}
+		if sampled > 0 {
+			size += elesize / int64(sampled) * v.Length()
+		}
+	}
+	return size
+}
+
+// 字典的哈希表和entry本身占的内存，不算key和value
+func dictOverhead(d *Dict) int64 {
+	return d.MemUsage()
+}
+
+// 客户端结构体、输入缓冲区和还没发出去的回复
+func clientsMemory() int64 {
+	var size int64
+	for _, c := range server.clients {
+		size += int64(unsafe.Sizeof(*c)) + int64(cap(c.queryBuf)) + int64(cap(c.buf))
+		for n := c.reply.First(); n != nil; n = n.Next() {
+			size += REPLY_NODE_SIZE + int64(cap(n.Val))
+		}
+	}
+	return size
+}
+
+/*
+MEMORY USAGE key [SAMPLES count]
+MEMORY STATS / DOCTOR / MALLOC-STATS / HELP
+*/
+func memoryCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "usage" && len(c.args) >= 3:
+		memoryUsageCommand(c)
+	case sub == "stats" && len(c.args) == 2:
+		memoryStatsCommand(c)
+	case sub == "doctor" && len(c.args) == 2:
+		report := getMemoryDoctorReport()
+		c.AddReplyVerbatim(report, "txt")
+	case sub == "malloc-stats" && len(c.args) == 2:
+		report := getMallocStats()
+		c.AddReplyVerbatim(report, "txt")
+	case sub == "help" && len(c.args) == 2:
+		help := []string{
+			"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"MALLOC-STATS",
+			"    Return internal statistics report from the memory allocator.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+			"HELP",
+			"    Print this help.",
+		}
+		c.AddReplyHelp(help)
+	default:
+		c.AddReplySubcommandSyntaxError()
+	}
+}
+
+/*
+key、value和entry加起来的大小，key不存在回复空
+*/
+func memoryUsageCommand(c *GodisClient) {
+	samples := OBJ_COMPUTE_SIZE_DEF_SAMPLES
+	for i := 3; i < len(c.args); i++ {
+		if strings.ToLower(c.args[i].StrVal()) == "samples" && i+1 < len(c.args) {
+			n, ok := getLongFromObjectOrReply(c, c.args[i+1], "")
+			if !ok {
+				return
+			}
+			if n < 0 {
+				c.AddReplyError("syntax error")
+				return
+			}
+			samples = int(n)
+			i++
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+	}
+	key := c.args[2]
+	expireIfNeeded(key)
+	entry := server.db.data.Find(key)
+	if entry == nil {
+		c.AddReplyNull()
+		return
+	}
+	usage := ENTRY_SIZE + objectSize(entry.Key) + objectComputeSize(entry.Val, samples)
+	c.AddReplyInt(usage)
+}
+
+/*
+内存的各项统计，名字 -> 值
+*/
+func memoryStatsCommand(c *GodisClient) {
+	used := zmallocUsedMemory()
+	mainOverhead := dictOverhead(server.db.data)
+	expiresOverhead := dictOverhead(server.db.expire)
+	clients := clientsMemory()
+	overhead := server.startupMemory + mainOverhead + expiresOverhead + clients
+	dataset := used - server.startupMemory - mainOverhead - expiresOverhead
+	if dataset < 0 {
+		dataset = 0
+	}
+	keys := server.db.data.Size()
+	var bytesPerKey int64
+	if keys > 0 {
+		bytesPerKey = (used - server.startupMemory) / keys
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	percent := func(a, b int64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return float64(a) * 100 / float64(b)
+	}
+	stats := []struct {
+		name string
+		val  interface{} // int64回复整数，float64回复浮点数
+	}{
+		{"peak.allocated", server.statPeakMemory},
+		{"total.allocated", used},
+		{"startup.allocated", server.startupMemory},
+		{"clients.normal", clients},
+		{"overhead.hashtable.main", mainOverhead},
+		{"overhead.hashtable.expires", expiresOverhead},
+		{"overhead.total", overhead},
+		{"keys.count", keys},
+		{"keys.bytes-per-key", bytesPerKey},
+		{"dataset.bytes", dataset},
+		{"dataset.percentage", percent(dataset, used-server.startupMemory)},
+		{"peak.percentage", percent(used, server.statPeakMemory)},
+		{"evicted.keys", server.statEvictedKeys},
+		{"runtime.heap.alloc", int64(ms.HeapAlloc)},
+		{"runtime.heap.sys", int64(ms.HeapSys)},
+		{"fragmentation", float64(ms.HeapSys) / float64(ms.HeapAlloc)},
+	}
+	c.AddReplyMapLen(len(stats))
+	for _, s := range stats {
+		c.AddReplyBulkString(s.name)
+		switch v := s.val.(type) {
+		case int64:
+			c.AddReplyInt(v)
+		case float64:
+			c.AddReplyDouble(v)
+		}
+	}
+}
+
+/*
+简单看看内存有没有什么问题
+1. 用得太少就不分析了
+2. 峰值比现在高很多
+3. 堆的碎片太多
+4. 客户端缓冲区太大
+*/
+func getMemoryDoctorReport() string {
+	used := zmallocUsedMemory()
+	if used < 1024*1024*5 {
+		return "The instance uses very little memory, there is nothing to analyze."
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var issues []string
+	if float64(server.statPeakMemory) > float64(used)*1.5 {
+		issues = append(issues, " * Peak memory: peak usage is more than 150% of current usage, memory freed after the peak may not be returned to the OS.")
+	}
+	if ms.HeapAlloc > 0 && float64(ms.HeapSys)/float64(ms.HeapAlloc) > 1.4 {
+		issues = append(issues, fmt.Sprintf(" * High fragmentation: the Go heap is %.2f times the live objects.",
+			float64(ms.HeapSys)/float64(ms.HeapAlloc)))
+	}
+	if n := len(server.clients); n > 0 && clientsMemory()/int64(n) > 1024*200 {
+		issues = append(issues, " * Big client buffers: clients use more than 200KB of buffers on average, check for slow clients or big pipelines.")
+	}
+	if len(issues) == 0 {
+		return "No memory issues found."
+	}
+	return "Memory issues found:\n\n" + strings.Join(issues, "\n")
+}
+
+// 没有jemalloc，给出go运行时的内存统计
+func getMallocStats() string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var sb strings.Builder
+	sb.WriteString("___ Begin go runtime statistics ___\n")
+	fmt.Fprintf(&sb, "Alloc: %d\nTotalAlloc: %d\nSys: %d\nMallocs: %d\nFrees: %d\n", ms.Alloc, ms.TotalAlloc, ms.Sys, ms.Mallocs, ms.Frees)
+	fmt.Fprintf(&sb, "HeapAlloc: %d\nHeapSys: %d\nHeapIdle: %d\nHeapInuse: %d\nHeapReleased: %d\nHeapObjects: %d\n",
+		ms.HeapAlloc, ms.HeapSys, ms.HeapIdle, ms.HeapInuse, ms.HeapReleased, ms.HeapObjects)
+	fmt.Fprintf(&sb, "StackInuse: %d\nStackSys: %d\nGCSys: %d\nNextGC: %d\nNumGC: %d\nPauseTotalNs: %d\n",
+		ms.StackInuse, ms.StackSys, ms.GCSys, ms.NextGC, ms.NumGC, ms.PauseTotalNs)
+	sb.WriteString("--- End go runtime statistics ---")
+	return sb.String()
+}
@@ -0,0 +1,170 @@
+package main
+
+/*
+事务 MULTI/EXEC/DISCARD 和乐观锁 WATCH
+MULTI之后的命令先放到客户端的队列里，EXEC的时候一口气执行完，中间不会插进别的客户端的命令
+WATCH的key在EXEC之前被改了，客户端会被标记为CLIENT_DIRTY_CAS，EXEC直接返回空
+*/
+
+// 事务中排队的命令
+type multiCmd struct {
+	args []*Gobj
+	cmd  *GodisCommand
+}
+
+// 事务中不排队，直接执行的命令
+func isMultiControlCommand(cmd *GodisCommand) bool {
+	switch cmd.name {
+	case "multi", "exec", "discard", "watch", "unwatch":
+		return true
+	}
+	return false
+}
+
+/*
+命令入队
+参数的所有权交给队列，置空之后resetClient就不会释放它们了
+*/
+func queueMultiCommand(c *GodisClient) {
+	c.mstate = append(c.mstate, multiCmd{args: c.args, cmd: c.cmd})
+	c.args = nil
+}
+
+// 释放队列里所有命令的参数
+func discardTransaction(c *GodisClient) {
+	for _, mc := range c.mstate {
+		for _, arg := range mc.args {
+			arg.DecrRefCount()
+		}
+	}
+	c.mstate = nil
+	c.flags &^= CLIENT_MULTI | CLIENT_DIRTY_CAS | CLIENT_DIRTY_EXEC | CLIENT_DENY_BLOCKING
+	unwatchAllKeys(c)
+}
+
+// 入队的时候出错了，EXEC的时候要拒绝执行
+func flagTransaction(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.flags |= CLIENT_DIRTY_EXEC
+	}
+}
+
+func multiCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.AddReplyError("MULTI calls can not be nested")
+		return
+	}
+	c.flags |= CLIENT_MULTI | CLIENT_DENY_BLOCKING
+	c.AddReplyStatus("OK")
+}
+
+func discardCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.AddReplyError("DISCARD without MULTI")
+		return
+	}
+	discardTransaction(c)
+	c.AddReplyStatus("OK")
+}
+
+/*
+执行事务
+1. 入队时有错误，返回EXECABORT
+2. WATCH的key过期了也算被修改，先检查一遍
+3. WATCH的key被修改过，返回空数组
+4. 依次执行队列里的命令，回复是一个数组
+*/
+func execCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.AddReplyError("EXEC without MULTI")
+		return
+	}
+	if c.flags&CLIENT_DIRTY_EXEC != 0 {
+		c.AddReplyError("-EXECABORT Transaction discarded because of previous errors.")
+		discardTransaction(c)
+		return
+	}
+	for _, key := range c.watchedKeys {
+		expireIfNeeded(key)
+	}
+	if c.flags&CLIENT_DIRTY_CAS != 0 {
+		c.AddReplyNullArray()
+		discardTransaction(c)
+		return
+	}
+	unwatchAllKeys(c) // 已经执行了，不需要再监视了
+
+	origArgs, origCmd := c.args, c.cmd
+	c.AddReplyArrayLen(len(c.mstate))
+	for _, mc := range c.mstate {
+		c.args = mc.args
+		c.cmd = mc.cmd
+		call(c)
+		freeArgs(c)
+	}
+	c.args, c.cmd = origArgs, origCmd
+	c.mstate = nil
+	c.flags &^= CLIENT_MULTI | CLIENT_DIRTY_CAS | CLIENT_DIRTY_EXEC | CLIENT_DENY_BLOCKING
+}
+
+/*
+监视一个key
+server.watchedKeys 保存 key -> 监视它的客户端
+*/
+func watchKey(c *GodisClient, key *Gobj) {
+	keyStr := key.StrVal()
+	clients := server.watchedKeys[keyStr]
+	if _, ok := clients[c.id]; ok {
+		return
+	}
+	if clients == nil {
+		clients = make(map[int64]*GodisClient)
+		server.watchedKeys[keyStr] = clients
+	}
+	clients[c.id] = c
+	key.IncrRefCount()
+	c.watchedKeys = append(c.watchedKeys, key)
+}
+
+func unwatchAllKeys(c *GodisClient) {
+	for _, key := range c.watchedKeys {
+		keyStr := key.StrVal()
+		clients := server.watchedKeys[keyStr]
+		delete(clients, c.id)
+		if len(clients) == 0 {
+			delete(server.watchedKeys, keyStr)
+		}
+		key.DecrRefCount()
+	}
+	c.watchedKeys = nil
+}
+
+/*
+key被修改了，监视它的客户端都标记为dirty
+*/
+func touchWatchedKey(key *Gobj) {
+	for _, c := range server.watchedKeys[key.StrVal()] {
+		c.flags |= CLIENT_DIRTY_CAS
+	}
+}
+
+/*
+已经过期的key先删掉再监视，这样之后它不会因为过期把事务弄脏
+*/
+func watchCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.AddReplyError("WATCH inside MULTI is not allowed")
+		return
+	}
+	for _, key := range c.args[1:] {
+		expireIfNeeded(key)
+		watchKey(c, key)
+	}
+	c.AddReplyStatus("OK")
+}
+
+func unwatchCommand(c *GodisClient) {
+	unwatchAllKeys(c)
+	c.flags &^= CLIENT_DIRTY_CAS
+	c.AddReplyStatus("OK")
+}
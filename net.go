@@ -1,16 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"golang.org/x/sys/unix"
 	"log"
+	"net"
+	"strings"
 )
 
-const BACKLOG int = 64
+const MAX_ACCEPTS_PER_CALL int = 1000 // 一次可读事件最多接收多少个连接
 
-// 接收连接
+// 接收连接，新的连接直接设置成非阻塞的
 func Accept(fd int) (int, error) {
 	// 忽略掉了客户端的地址
-	nfd, _, err := unix.Accept(fd)
+	nfd, _, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
 	return nfd, err
 }
 
@@ -38,35 +41,123 @@ func Write(fd int, buf []byte) (int, error) {
 	return unix.Write(fd, buf)
 }
 
+// 多块缓冲区一次系统调用写出去
+func Writev(fd int, iovs [][]byte) (int, error) {
+	return unix.Writev(fd, iovs)
+}
+
 func Close(fd int) {
 	unix.Close(fd)
 }
 
-func TcpServer(port int) (int, error) {
-	s, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0) // SOCK_STREAM TCP连接
-	if err != nil {
-		log.Printf("init socket err: %v\n", err)
-		return -1, err
+/*
+在一个地址上监听
+1. "*" 是所有IPv4地址，"::*" 是所有IPv6地址，其他的按IP解析，带冒号的是IPv6
+2. 设置SO_REUSEADDR，重启的时候不会因为上次的连接还在TIME_WAIT而绑不上
+3. IPv6的socket只收IPv6的连接，不然同一个端口再监听IPv4会冲突
+*/
+func TcpServer(addr string, port int, backlog int) (int, error) {
+	var sa unix.Sockaddr
+	switch addr {
+	case "*":
+		sa = &unix.SockaddrInet4{Port: port}
+	case "::*":
+		sa = &unix.SockaddrInet6{Port: port}
+	default:
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return -1, fmt.Errorf("invalid bind address '%s'", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil && !strings.Contains(addr, ":") {
+			sa4 := &unix.SockaddrInet4{Port: port}
+			copy(sa4.Addr[:], ip4)
+			sa = sa4
+		} else {
+			sa6 := &unix.SockaddrInet6{Port: port}
+			copy(sa6.Addr[:], ip.To16())
+			sa = sa6
+		}
+	}
+	family := unix.AF_INET
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		family = unix.AF_INET6
 	}
-	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, port) // TODO 不懂这里的SO_REUSEPORT，和SO_REUSEADDR有什么区别
+
+	s, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0) // SOCK_STREAM TCP连接
 	if err != nil {
-		log.Printf("set SO_REUSEPORT err: %v\n", err)
+		return -1, fmt.Errorf("socket: %w", err)
+	}
+	if err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
 		unix.Close(s)
-		return -1, nil
+		return -1, fmt.Errorf("setsockopt SO_REUSEADDR: %w", err)
 	}
-	var addr unix.SockaddrInet4
-	addr.Port = port
-	unix.Bind(s, &addr)
-	if err != nil {
-		log.Printf("bind addr err: %v\n", err)
+	if family == unix.AF_INET6 {
+		if err = unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+			unix.Close(s)
+			return -1, fmt.Errorf("setsockopt IPV6_V6ONLY: %w", err)
+		}
+	}
+	if err = unix.Bind(s, sa); err != nil {
 		unix.Close(s)
-		return -1, nil
+		return -1, fmt.Errorf("bind: %w", err)
 	}
-	err = unix.Listen(s, BACKLOG)
+	if err = unix.Listen(s, backlog); err != nil {
+		unix.Close(s)
+		return -1, fmt.Errorf("listen: %w", err)
+	}
+	return s, nil
+}
+
+/*
+在unix socket上监听
+1. 文件已经存在的话先删掉，可能是上次没有正常退出留下的
+2. perm不为0的话在listen之前修改文件的权限，控制哪些用户能连上来
+*/
+func UnixServer(path string, perm uint32, backlog int) (int, error) {
+	s, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
-		log.Printf("listen socket err: %v\n", err)
+		return -1, fmt.Errorf("socket: %w", err)
+	}
+	unix.Unlink(path) // 删不掉也没关系，bind会报错
+	if err = unix.Bind(s, &unix.SockaddrUnix{Name: path}); err != nil {
 		unix.Close(s)
-		return -1, err
+		return -1, fmt.Errorf("bind: %w", err)
+	}
+	if perm != 0 { // 不然listen之后、改权限之前谁都能连上来
+		if err = unix.Chmod(path, perm); err != nil {
+			unix.Close(s)
+			return -1, fmt.Errorf("chmod: %w", err)
+		}
+	}
+	if err = unix.Listen(s, backlog); err != nil {
+		unix.Close(s)
+		return -1, fmt.Errorf("listen: %w", err)
 	}
 	return s, nil
 }
+
+// 关掉Nagle算法，小的回复也马上发出去
+func EnableTcpNoDelay(fd int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+}
+
+/*
+开启TCP keepalive，和redis一样
+interval秒没有数据就开始探测，之后每interval/3秒探测一次，3次没有回应就认为连接断了
+*/
+func KeepAlive(fd int, interval int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, interval); err != nil {
+		return err
+	}
+	probeInterval := interval / 3
+	if probeInterval == 0 {
+		probeInterval = 1
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, probeInterval); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+键空间通知
+配置 notify-keyspace-events 用字母表示要发哪些事件，和redis一样
+key被修改的时候，往 __keyspace@<db>__:<key> 发事件名，往 __keyevent@<db>__:<event> 发key
+*/
+
+const (
+	NOTIFY_KEYSPACE int = 1 << 0  // K
+	NOTIFY_KEYEVENT int = 1 << 1  // E
+	NOTIFY_GENERIC  int = 1 << 2  // g
+	NOTIFY_STRING   int = 1 << 3  // $
+	NOTIFY_LIST     int = 1 << 4  // l
+	NOTIFY_SET      int = 1 << 5  // s
+	NOTIFY_HASH     int = 1 << 6  // h
+	NOTIFY_ZSET     int = 1 << 7  // z
+	NOTIFY_EXPIRED  int = 1 << 8  // x
+	NOTIFY_EVICTED  int = 1 << 9  // e
+	NOTIFY_STREAM   int = 1 << 10 // t
+	NOTIFY_KEY_MISS int = 1 << 11 // m
+	NOTIFY_MODULE   int = 1 << 12 // d
+	NOTIFY_NEW      int = 1 << 13 // n
+	NOTIFY_ALL      int = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM | NOTIFY_MODULE // A
+)
+
+/*
+把配置的字符串转成标志位，有不认识的字母就返回错误
+*/
+func keyspaceEventsStringToFlags(classes string) (int, error) {
+	flags := 0
+	for _, ch := range classes {
+		switch ch {
+		case 'A':
+			flags |= NOTIFY_ALL
+		case 'g':
+			flags |= NOTIFY_GENERIC
+		case '$':
+			flags |= NOTIFY_STRING
+		case 'l':
+			flags |= NOTIFY_LIST
+		case 's':
+			flags |= NOTIFY_SET
+		case 'h':
+			flags |= NOTIFY_HASH
+		case 'z':
+			flags |= NOTIFY_ZSET
+		case 'x':
+			flags |= NOTIFY_EXPIRED
+		case 'e':
+			flags |= NOTIFY_EVICTED
+		case 'K':
+			flags |= NOTIFY_KEYSPACE
+		case 'E':
+			flags |= NOTIFY_KEYEVENT
+		case 't':
+			flags |= NOTIFY_STREAM
+		case 'm':
+			flags |= NOTIFY_KEY_MISS
+		case 'd':
+			flags |= NOTIFY_MODULE
+		case 'n':
+			flags |= NOTIFY_NEW
+		default:
+			return 0, fmt.Errorf("invalid notify-keyspace-events class '%c'", ch)
+		}
+	}
+	return flags, nil
+}
+
+/*
+标志位转回字符串，能用A表示的就用A
+*/
+func keyspaceEventsFlagsToString(flags int) string {
+	var sb strings.Builder
+	if flags&NOTIFY_ALL == NOTIFY_ALL {
+		sb.WriteByte('A')
+	} else {
+		for _, p := range []struct {
+			flag int
+			ch   byte
+		}{
+			{NOTIFY_GENERIC, 'g'}, {NOTIFY_STRING, '$'}, {NOTIFY_LIST, 'l'}, {NOTIFY_SET, 's'},
+			{NOTIFY_HASH, 'h'}, {NOTIFY_ZSET, 'z'}, {NOTIFY_EXPIRED, 'x'}, {NOTIFY_EVICTED, 'e'},
+			{NOTIFY_STREAM, 't'}, {NOTIFY_MODULE, 'd'},
+		} {
+			if flags&p.flag != 0 {
+				sb.WriteByte(p.ch)
+			}
+		}
+	}
+	if flags&NOTIFY_KEYSPACE != 0 {
+		sb.WriteByte('K')
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		sb.WriteByte('E')
+	}
+	if flags&NOTIFY_KEY_MISS != 0 {
+		sb.WriteByte('m')
+	}
+	if flags&NOTIFY_NEW != 0 {
+		sb.WriteByte('n')
+	}
+	return sb.String()
+}
+
+/*
+发送键空间通知
+1. 这类事件没有开启，直接返回
+2. K: 往 __keyspace@<db>__:<key> 发布事件名
+3. E: 往 __keyevent@<db>__:<event> 发布key
+*/
+func notifyKeyspaceEvent(typ int, event string, key *Gobj, dbid int) {
+	flags := server.notifyKeyspaceEvents
+	if flags&typ == 0 {
+		return
+	}
+	keyStr := key.StrVal()
+	if flags&NOTIFY_KEYSPACE != 0 {
+		channel := fmt.Sprintf("__keyspace@%d__:%s", dbid, keyStr)
+		pubsubPublishMessage(channel, event)
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		channel := fmt.Sprintf("__keyevent@%d__:%s", dbid, event)
+		pubsubPublishMessage(channel, keyStr)
+	}
+}
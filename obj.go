@@ -1,6 +1,10 @@
 package main
 
-import "strconv"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
 
 type Gtype uint8
 
@@ -11,19 +15,87 @@ const (
 	GZSET Gtype = 0x03
 )
 
+// 对象的编码，同一种类型可以有不同的底层实现
+const (
+	OBJ_ENCODING_RAW        uint8 = 0
+	OBJ_ENCODING_INT        uint8 = 1
+	OBJ_ENCODING_HT         uint8 = 2
+	OBJ_ENCODING_LINKEDLIST uint8 = 4
+	OBJ_ENCODING_SKIPLIST   uint8 = 7
+	OBJ_ENCODING_EMBSTR     uint8 = 8
+	OBJ_ENCODING_QUICKLIST  uint8 = 9
+	OBJ_ENCODING_LISTPACK   uint8 = 11
+)
+
+const (
+	OBJ_SHARED_INTEGERS            int64 = 10000         // 共享的整数对象 0~9999
+	OBJ_SHARED_REFCOUNT            int   = math.MaxInt32 // 共享对象的引用计数，不会加减
+	OBJ_ENCODING_EMBSTR_SIZE_LIMIT int   = 44            // 不超过这个长度的字符串用embstr编码
+)
+
 type Gval interface{}
 
 type Gobj struct {
 	Type     Gtype
+	encoding uint8
 	Val      Gval
-	refCount int // 用于引用计数
+	refCount int    // 用于引用计数
+	lru      uint32 // LRU时钟，LFU策略下高16位是分钟时间，低8位是访问计数
+}
+
+// 根据Val的实际类型决定编码
+func objectEncodingOf(ptr interface{}) uint8 {
+	switch ptr.(type) {
+	case *List:
+		return OBJ_ENCODING_LINKEDLIST
+	case *ZSet:
+		return OBJ_ENCODING_SKIPLIST
+	case *Dict:
+		return OBJ_ENCODING_HT
+	case *Listpack:
+		return OBJ_ENCODING_LISTPACK
+	case *Quicklist:
+		return OBJ_ENCODING_QUICKLIST
+	}
+	return OBJ_ENCODING_RAW
+}
+
+func strEncoding(encoding uint8) string {
+	switch encoding {
+	case OBJ_ENCODING_RAW:
+		return "raw"
+	case OBJ_ENCODING_INT:
+		return "int"
+	case OBJ_ENCODING_HT:
+		return "hashtable"
+	case OBJ_ENCODING_LINKEDLIST:
+		return "linkedlist"
+	case OBJ_ENCODING_SKIPLIST:
+		return "skiplist"
+	case OBJ_ENCODING_EMBSTR:
+		return "embstr"
+	case OBJ_ENCODING_QUICKLIST:
+		return "quicklist"
+	case OBJ_ENCODING_LISTPACK:
+		return "listpack"
+	}
+	return "unknown"
 }
 
+/*
+字符串对象有三种编码
+raw: Val是string
+embstr: Val是*string，指向和对象一起分配的字段，少一次分配
+int: Val是int64
+*/
 func (o *Gobj) IntVal() int64 {
 	if o.Type != GSTR {
 		return 0
 	}
-	val, _ := strconv.ParseInt(o.Val.(string), 10, 64)
+	if v, ok := o.Val.(int64); ok {
+		return v
+	}
+	val, _ := strconv.ParseInt(o.StrVal(), 10, 64)
 	return val
 }
 
@@ -31,33 +103,220 @@ func (o *Gobj) StrVal() string {
 	if o.Type != GSTR {
 		return ""
 	}
-	return o.Val.(string)
+	switch v := o.Val.(type) {
+	case string:
+		return v
+	case *string:
+		return *v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
+
+// 共享的整数对象，不会被释放
+var sharedIntegers [OBJ_SHARED_INTEGERS]*Gobj
+
+func createSharedObjects() {
+	for i := range sharedIntegers {
+		sharedIntegers[i] = &Gobj{
+			Type:     GSTR,
+			encoding: OBJ_ENCODING_INT,
+			Val:      int64(i),
+			refCount: OBJ_SHARED_REFCOUNT,
+		}
+	}
+}
+
+/*
+LRU/LFU淘汰要用对象自己的访问时间，共享对象的lru字段是大家共用的，这时候不能共享
+*/
+func canUseSharedIntegers() bool {
+	return server.maxmemory == 0 || server.maxmemoryPolicy&(MAXMEMORY_FLAG_LRU|MAXMEMORY_FLAG_LFU) == 0
 }
 
 func CreateFromInt(val int64) *Gobj {
+	if val >= 0 && val < OBJ_SHARED_INTEGERS && canUseSharedIntegers() {
+		return sharedIntegers[val]
+	}
 	return &Gobj{
 		Type:     GSTR,
-		Val:      strconv.FormatInt(val, 10),
+		encoding: OBJ_ENCODING_INT,
+		Val:      val,
 		refCount: 1,
+		lru:      initObjectLRU(),
 	}
 }
 
+// embstr编码的对象，字符串头和对象在一起分配
+type embstrObject struct {
+	Gobj
+	str string
+}
+
+func createEmbeddedStringObject(s string) *Gobj {
+	e := &embstrObject{str: s}
+	e.Gobj = Gobj{
+		Type:     GSTR,
+		encoding: OBJ_ENCODING_EMBSTR,
+		Val:      &e.str,
+		refCount: 1,
+		lru:      initObjectLRU(),
+	}
+	return &e.Gobj
+}
+
 func CreateObject(typ Gtype, ptr interface{}) *Gobj {
+	if s, ok := ptr.(string); ok && typ == GSTR && len(s) <= OBJ_ENCODING_EMBSTR_SIZE_LIMIT {
+		return createEmbeddedStringObject(s)
+	}
 	return &Gobj{
 		Type:     typ,
+		encoding: objectEncodingOf(ptr),
 		Val:      ptr,
 		refCount: 1,
+		lru:      initObjectLRU(),
+	}
+}
+
+/*
+尝试把字符串对象换成更省内存的编码，保存到db之前调用
+1. 被别人引用着的对象不能改
+2. 能转成整数的，小整数直接用共享对象，否则改成int编码
+3. 短字符串用embstr
+返回的对象可能不是原来那个，原来的引用计数已经减掉了
+*/
+func tryObjectEncoding(o *Gobj) *Gobj {
+	if o.Type != GSTR || o.refCount > 1 || o.encoding == OBJ_ENCODING_INT {
+		return o
+	}
+	s := o.StrVal()
+	if len(s) <= 20 {
+		if val, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(val, 10) == s {
+			if val >= 0 && val < OBJ_SHARED_INTEGERS && canUseSharedIntegers() {
+				o.DecrRefCount()
+				return sharedIntegers[val]
+			}
+			o.encoding = OBJ_ENCODING_INT
+			o.Val = val
+			return o
+		}
 	}
+	if o.encoding == OBJ_ENCODING_RAW && len(s) <= OBJ_ENCODING_EMBSTR_SIZE_LIMIT {
+		emb := createEmbeddedStringObject(s)
+		o.DecrRefCount()
+		return emb
+	}
+	return o
 }
 
 func (o *Gobj) IncrRefCount() {
+	if o.refCount == OBJ_SHARED_REFCOUNT {
+		return
+	}
 	o.refCount++
 }
 
 func (o *Gobj) DecrRefCount() {
+	if o.refCount == OBJ_SHARED_REFCOUNT {
+		return
+	}
 	o.refCount--
 	if o.refCount == 0 {
 		// 把回收的任务交给GC
+		freeObjectContents(o)
 		o.Val = nil
 	}
 }
+
+/*
+把对象解析成整数，解析失败就回复错误
+msg为空时用默认的错误信息
+*/
+func getLongFromObjectOrReply(c *GodisClient, o *Gobj, msg string) (int64, bool) {
+	val, err := strconv.ParseInt(o.StrVal(), 10, 64)
+	if o.Type != GSTR || err != nil {
+		if msg == "" {
+			msg = "value is not an integer or out of range"
+		}
+		c.AddReplyError(msg)
+		return 0, false
+	}
+	return val, true
+}
+
+/*
+把对象解析成浮点数，NaN也算错误
+*/
+func getFloatFromObjectOrReply(c *GodisClient, o *Gobj, msg string) (float64, bool) {
+	val, err := strconv.ParseFloat(o.StrVal(), 64)
+	if o.Type != GSTR || err != nil || math.IsNaN(val) {
+		if msg == "" {
+			msg = "value is not a valid float"
+		}
+		c.AddReplyError(msg)
+		return 0, false
+	}
+	return val, true
+}
+
+/*
+OBJECT ENCODING/REFCOUNT/IDLETIME/FREQ key
+只是看看，不更新访问时间
+*/
+func objectCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	if sub == "help" && len(c.args) == 2 {
+		help := []string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+			"HELP",
+			"    Print this help.",
+		}
+		c.AddReplyHelp(help)
+		return
+	}
+	if len(c.args) != 3 || (sub != "encoding" && sub != "refcount" && sub != "idletime" && sub != "freq") {
+		c.AddReplySubcommandSyntaxError()
+		return
+	}
+	key := c.args[2]
+	expireIfNeeded(key)
+	o := server.db.data.Get(key)
+	if o == nil {
+		c.AddReplyNull()
+		return
+	}
+	switch sub {
+	case "encoding":
+		enc := strEncoding(o.encoding)
+		c.AddReplyBulkString(enc)
+	case "refcount":
+		c.AddReplyInt(int64(o.refCount))
+	case "idletime":
+		if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+			c.AddReplyError("An LFU maxmemory policy is selected, idle time not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		c.AddReplyInt(int64(estimateObjectIdleTime(o) / 1000))
+	case "freq":
+		if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU == 0 {
+			c.AddReplyError("An LFU maxmemory policy is not selected, access frequency not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		c.AddReplyInt(int64(LFUDecrAndReturn(o)))
+	}
+}
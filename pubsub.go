@@ -0,0 +1,200 @@
+package main
+
+/*
+发布订阅
+server.pubsubChannels 保存 频道 -> 订阅的客户端
+client.pubsubChannels 保存 客户端订阅了哪些频道
+模式订阅也一样，放在 pubsubPatterns 里
+只要订阅了至少一个频道或者模式，客户端就处于订阅模式
+*/
+
+func pubsubSubscriptionCount(c *GodisClient) int {
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+// 更新订阅模式的标志位
+func pubsubUpdateFlag(c *GodisClient) {
+	if pubsubSubscriptionCount(c) > 0 {
+		c.flags |= CLIENT_PUBSUB
+	} else {
+		c.flags &^= CLIENT_PUBSUB
+	}
+}
+
+// 订阅一个频道，已经订阅过就什么都不做
+func pubsubSubscribeChannel(c *GodisClient, channel string) {
+	if _, ok := c.pubsubChannels[channel]; !ok {
+		if c.pubsubChannels == nil {
+			c.pubsubChannels = make(map[string]struct{})
+		}
+		c.pubsubChannels[channel] = struct{}{}
+		clients := server.pubsubChannels[channel]
+		if clients == nil {
+			clients = make(map[int64]*GodisClient)
+			server.pubsubChannels[channel] = clients
+		}
+		clients[c.id] = c
+	}
+	pubsubUpdateFlag(c)
+	addReplyPubsubSubscription(c, "subscribe", &channel)
+}
+
+// 取消订阅一个频道，notify为false时不回复客户端(客户端断开的时候)
+func pubsubUnsubscribeChannel(c *GodisClient, channel string, notify bool) {
+	if _, ok := c.pubsubChannels[channel]; ok {
+		delete(c.pubsubChannels, channel)
+		clients := server.pubsubChannels[channel]
+		delete(clients, c.id)
+		if len(clients) == 0 {
+			delete(server.pubsubChannels, channel)
+		}
+	}
+	pubsubUpdateFlag(c)
+	if notify {
+		addReplyPubsubSubscription(c, "unsubscribe", &channel)
+	}
+}
+
+func pubsubUnsubscribeAllChannels(c *GodisClient) {
+	for channel := range c.pubsubChannels {
+		pubsubUnsubscribeChannel(c, channel, false)
+	}
+}
+
+// 订阅一个模式
+func pubsubSubscribePattern(c *GodisClient, pattern string) {
+	if _, ok := c.pubsubPatterns[pattern]; !ok {
+		if c.pubsubPatterns == nil {
+			c.pubsubPatterns = make(map[string]struct{})
+		}
+		c.pubsubPatterns[pattern] = struct{}{}
+		clients := server.pubsubPatterns[pattern]
+		if clients == nil {
+			clients = make(map[int64]*GodisClient)
+			server.pubsubPatterns[pattern] = clients
+		}
+		clients[c.id] = c
+	}
+	pubsubUpdateFlag(c)
+	addReplyPubsubSubscription(c, "psubscribe", &pattern)
+}
+
+// 取消订阅一个模式
+func pubsubUnsubscribePattern(c *GodisClient, pattern string, notify bool) {
+	if _, ok := c.pubsubPatterns[pattern]; ok {
+		delete(c.pubsubPatterns, pattern)
+		clients := server.pubsubPatterns[pattern]
+		delete(clients, c.id)
+		if len(clients) == 0 {
+			delete(server.pubsubPatterns, pattern)
+		}
+	}
+	pubsubUpdateFlag(c)
+	if notify {
+		addReplyPubsubSubscription(c, "punsubscribe", &pattern)
+	}
+}
+
+func pubsubUnsubscribeAllPatterns(c *GodisClient) {
+	for pattern := range c.pubsubPatterns {
+		pubsubUnsubscribePattern(c, pattern, false)
+	}
+}
+
+/*
+订阅和退订的回复：[类型, 频道, 现在一共订阅了多少]
+channel为nil表示本来就没订阅，频道那一项回复null
+*/
+func addReplyPubsubSubscription(c *GodisClient, kind string, channel *string) {
+	c.AddReplyPushLen(3)
+	c.AddReplyBulkString(kind)
+	if channel == nil {
+		c.AddReplyNull()
+	} else {
+		c.AddReplyBulkString(*channel)
+	}
+	c.AddReplyInt(int64(pubsubSubscriptionCount(c)))
+}
+
+/*
+发布消息
+1. 发给所有订阅了这个频道的客户端
+2. 再发给所有模式能匹配上这个频道的客户端
+返回收到消息的客户端数量
+*/
+func pubsubPublishMessage(channel, message string) int {
+	receivers := 0
+	for _, c := range server.pubsubChannels[channel] {
+		c.AddReplyPushLen(3)
+		c.AddReplyBulkString("message")
+		c.AddReplyBulkString(channel)
+		c.AddReplyBulkString(message)
+		receivers++
+	}
+	for pattern, clients := range server.pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for _, c := range clients {
+			c.AddReplyPushLen(4)
+			c.AddReplyBulkString("pmessage")
+			c.AddReplyBulkString(pattern)
+			c.AddReplyBulkString(channel)
+			c.AddReplyBulkString(message)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+func subscribeCommand(c *GodisClient) {
+	for _, arg := range c.args[1:] {
+		pubsubSubscribeChannel(c, arg.StrVal())
+	}
+}
+
+/*
+不带参数的时候，取消所有订阅
+*/
+func unsubscribeCommand(c *GodisClient) {
+	if len(c.args) > 1 {
+		for _, arg := range c.args[1:] {
+			pubsubUnsubscribeChannel(c, arg.StrVal(), true)
+		}
+		return
+	}
+	if len(c.pubsubChannels) == 0 {
+		addReplyPubsubSubscription(c, "unsubscribe", nil)
+		return
+	}
+	for channel := range c.pubsubChannels {
+		pubsubUnsubscribeChannel(c, channel, true)
+	}
+}
+
+func psubscribeCommand(c *GodisClient) {
+	for _, arg := range c.args[1:] {
+		pubsubSubscribePattern(c, arg.StrVal())
+	}
+}
+
+func punsubscribeCommand(c *GodisClient) {
+	if len(c.args) > 1 {
+		for _, arg := range c.args[1:] {
+			pubsubUnsubscribePattern(c, arg.StrVal(), true)
+		}
+		return
+	}
+	if len(c.pubsubPatterns) == 0 {
+		addReplyPubsubSubscription(c, "punsubscribe", nil)
+		return
+	}
+	for pattern := range c.pubsubPatterns {
+		pubsubUnsubscribePattern(c, pattern, true)
+	}
+}
+
+func publishCommand(c *GodisClient) {
+	receivers := pubsubPublishMessage(c.args[1].StrVal(), c.args[2].StrVal())
+	c.AddReplyInt(int64(receivers))
+}
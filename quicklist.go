@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+/*
+quicklist，双向链表，每个节点是一个listpack
+1. list-max-listpack-size 为正数时限制每个节点的元素个数，为负数时限制节点的字节数(-1:4k ... -5:64k)
+2. list-compress-depth 为n时，两头各n个节点不压缩，中间的节点用deflate压缩
+   push/pop只动两头的节点，所以还是O(1)
+*/
+
+const (
+	QUICKLIST_HEAD int = 0
+	QUICKLIST_TAIL int = 1
+
+	SIZE_SAFETY_LIMIT    int = 8192 // 按个数限制的时候，节点也不能超过这么大
+	MIN_COMPRESS_BYTES   int = 48   // 太小的节点不压缩
+	MIN_COMPRESS_IMPROVE int = 8    // 压缩后至少要省这么多字节
+)
+
+// list-max-listpack-size 为负数时每个节点最多多少字节
+var optimizationLevel = []int{4096, 8192, 16384, 32768, 65536}
+
+type quicklistNode struct {
+	prev       *quicklistNode
+	next       *quicklistNode
+	lp         *Listpack // 压缩了的话是nil
+	compressed []byte    // 压缩后的数据
+	count      int       // 元素个数
+	sz         int       // 没压缩时listpack的字节数
+	recompress bool      // 临时解压出来用的，用完要再压回去
+	attempted  bool      // 试过压缩但是压不小
+}
+
+type Quicklist struct {
+	head     *quicklistNode
+	tail     *quicklistNode
+	count    int64 // 所有节点的元素个数
+	len      int   // 节点个数
+	fill     int
+	compress int
+}
+
+func QuicklistCreate(fill, compress int) *Quicklist {
+	return &Quicklist{fill: fill, compress: compress}
+}
+
+func (ql *Quicklist) Count() int64 {
+	return ql.count
+}
+
+/*
+sz字节、count个元素的节点有没有超过限制
+*/
+func quicklistNodeExceedsLimit(fill int, sz, count int) bool {
+	if fill >= 0 {
+		return count > fill || sz > SIZE_SAFETY_LIMIT
+	}
+	level := -fill - 1
+	if level >= len(optimizationLevel) {
+		level = len(optimizationLevel) - 1
+	}
+	return sz > optimizationLevel[level]
+}
+
+// 往节点里再放一个sz字节的元素还行不行
+func (ql *Quicklist) nodeAllowInsert(node *quicklistNode, sz int) bool {
+	if node == nil {
+		return false
+	}
+	// 每个元素还有编码和backlen的开销，粗略加上11字节
+	return !quicklistNodeExceedsLimit(ql.fill, node.sz+sz+11, node.count+1)
+}
+
+// listpack改过之后调用，内容变了，之前压不小不代表现在也压不小
+func (node *quicklistNode) updateSz() {
+	node.sz = node.lp.Bytes()
+	node.attempted = false
+}
+
+/*
+压缩节点，压不小就不压了
+*/
+func (node *quicklistNode) compress() {
+	if node.lp == nil {
+		return
+	}
+	node.recompress = false
+	if node.sz < MIN_COMPRESS_BYTES || node.attempted {
+		return
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(node.lp.buf)
+	w.Close()
+	if buf.Len()+MIN_COMPRESS_IMPROVE >= node.sz {
+		node.attempted = true
+		return
+	}
+	node.compressed = buf.Bytes()
+	zmalloc(int64(len(node.compressed)))
+	zfree(int64(node.lp.Bytes()))
+	node.lp = nil
+}
+
+func (node *quicklistNode) decompress() {
+	if node.lp != nil {
+		return
+	}
+	raw, _ := io.ReadAll(flate.NewReader(bytes.NewReader(node.compressed)))
+	zmalloc(int64(len(raw)))
+	zfree(int64(len(node.compressed)))
+	node.lp = &Listpack{buf: raw}
+	node.compressed = nil
+}
+
+// 临时解压出来用，之后recompressOnly再压回去
+func (node *quicklistNode) decompressForUse() {
+	if node.lp == nil {
+		node.decompress()
+		node.recompress = true
+	}
+}
+
+func (node *quicklistNode) recompressOnly() {
+	if node.recompress {
+		node.compress()
+	}
+}
+
+/*
+保证两头各compress个节点是解压的，紧挨着它们的节点压缩掉
+node不在两头的话也压缩
+*/
+func (ql *Quicklist) compressNode(node *quicklistNode) {
+	if ql.compress == 0 || ql.len < ql.compress*2 {
+		return
+	}
+	forward, reverse := ql.head, ql.tail
+	inDepth := false
+	for depth := 0; depth < ql.compress; depth++ {
+		forward.decompress()
+		reverse.decompress()
+		if forward == node || reverse == node {
+			inDepth = true
+		}
+		if forward == reverse || forward.next == reverse {
+			return
+		}
+		forward = forward.next
+		reverse = reverse.prev
+	}
+	if !inDepth && node != nil {
+		node.compress()
+	}
+	forward.compress()
+	reverse.compress()
+}
+
+func (ql *Quicklist) createNode() *quicklistNode {
+	lp := lpNew()
+	zmalloc(QUICKLIST_NODE_SIZE)
+	return &quicklistNode{lp: lp, sz: lp.Bytes()}
+}
+
+// 把新节点放到head前面或者tail后面
+func (ql *Quicklist) insertNode(node *quicklistNode, where int) {
+	var old *quicklistNode
+	if where == QUICKLIST_HEAD {
+		old = ql.head
+		node.next = old
+		if old != nil {
+			old.prev = node
+		} else {
+			ql.tail = node
+		}
+		ql.head = node
+	} else {
+		old = ql.tail
+		node.prev = old
+		if old != nil {
+			old.next = node
+		} else {
+			ql.head = node
+		}
+		ql.tail = node
+	}
+	ql.len++
+	if old != nil {
+		ql.compressNode(old)
+	}
+}
+
+func (ql *Quicklist) delNode(node *quicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+	zfree(QUICKLIST_NODE_SIZE + node.bytes())
+	ql.len--
+	ql.count -= int64(node.count)
+	ql.compressNode(nil)
+}
+
+/*
+从头或者尾插入，放不下就新建一个节点
+*/
+func (ql *Quicklist) Push(val string, where int) {
+	node := ql.head
+	if where == QUICKLIST_TAIL {
+		node = ql.tail
+	}
+	if node != nil {
+		node.decompress()
+	}
+	if !ql.nodeAllowInsert(node, len(val)) {
+		node = ql.createNode()
+		ql.insertNode(node, where)
+	}
+	if where == QUICKLIST_HEAD {
+		node.lp.Prepend(val)
+	} else {
+		node.lp.Append(val)
+	}
+	node.count++
+	node.updateSz()
+	ql.count++
+}
+
+/*
+从头或者尾弹出一个元素，节点空了就删掉
+*/
+func (ql *Quicklist) Pop(where int) (string, bool) {
+	node := ql.head
+	if where == QUICKLIST_TAIL {
+		node = ql.tail
+	}
+	if node == nil {
+		return "", false
+	}
+	node.decompress() // 两头的节点本来就不该是压缩的，列表变短之后可能还留着
+	var p int
+	if where == QUICKLIST_HEAD {
+		p = node.lp.First()
+	} else {
+		p = node.lp.Last()
+	}
+	val := node.lp.Get(p)
+	node.lp.Delete(p)
+	node.count--
+	node.updateSz()
+	ql.count--
+	if node.count == 0 {
+		ql.delNode(node)
+	}
+	return val, true
+}
+
+/*
+从下标start开始往后访问n个元素
+中间压缩了的节点临时解压，用完再压回去
+*/
+func (ql *Quicklist) Range(start, n int64, fn func(val string)) {
+	node := ql.head
+	for node != nil && start >= int64(node.count) {
+		start -= int64(node.count)
+		node = node.next
+	}
+	for ; node != nil && n > 0; node = node.next {
+		node.decompressForUse()
+		p := node.lp.Seek(int(start))
+		for ; p != -1 && n > 0; p = node.lp.Next(p) {
+			fn(node.lp.Get(p))
+			n--
+		}
+		node.recompressOnly()
+		start = 0
+	}
+}
+
+// 节点实际占的字节数，压缩了的话是压缩后的大小
+func (node *quicklistNode) bytes() int64 {
+	if node.lp != nil {
+		return int64(node.lp.Bytes())
+	}
+	return int64(len(node.compressed))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func qlElements(ql *Quicklist) []string {
+	var eles []string
+	ql.Range(0, ql.Count(), func(val string) {
+		eles = append(eles, val)
+	})
+	return eles
+}
+
+func checkQuicklist(t *testing.T, ql *Quicklist, want []string) {
+	t.Helper()
+	if ql.Count() != int64(len(want)) {
+		t.Fatalf("count = %d, want %d", ql.Count(), len(want))
+	}
+	got := qlElements(ql)
+	if len(got) != len(want) {
+		t.Fatalf("range returned %d elements, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("element %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+	n, nodes := 0, 0
+	for node := ql.head; node != nil; node = node.next {
+		if node.count == 0 {
+			t.Fatal("empty node left in the quicklist")
+		}
+		n += node.count
+		nodes++
+	}
+	if n != len(want) || nodes != ql.len {
+		t.Fatalf("nodes hold %d elements in %d nodes, want %d in %d", n, nodes, len(want), ql.len)
+	}
+}
+
+func TestQuicklistPushPop(t *testing.T) {
+	ql := QuicklistCreate(4, 0)
+	var want []string
+	for i := 0; i < 50; i++ {
+		v := strconv.Itoa(i)
+		if i%2 == 0 {
+			ql.Push(v, QUICKLIST_TAIL)
+			want = append(want, v)
+		} else {
+			ql.Push(v, QUICKLIST_HEAD)
+			want = append([]string{v}, want...)
+		}
+	}
+	checkQuicklist(t, ql, want)
+	for node := ql.head; node != nil; node = node.next {
+		if node.count > 4 {
+			t.Fatalf("node holds %d elements, fill is 4", node.count)
+		}
+	}
+
+	var got []string
+	ql.Range(10, 5, func(val string) { got = append(got, val) })
+	if strings.Join(got, ",") != strings.Join(want[10:15], ",") {
+		t.Fatalf("range(10, 5) = %v, want %v", got, want[10:15])
+	}
+
+	for len(want) > 0 {
+		v, ok := ql.Pop(QUICKLIST_HEAD)
+		if !ok || v != want[0] {
+			t.Fatalf("pop head = %q %v, want %q", v, ok, want[0])
+		}
+		want = want[1:]
+		if len(want) == 0 {
+			break
+		}
+		v, ok = ql.Pop(QUICKLIST_TAIL)
+		if !ok || v != want[len(want)-1] {
+			t.Fatalf("pop tail = %q %v, want %q", v, ok, want[len(want)-1])
+		}
+		want = want[:len(want)-1]
+	}
+	checkQuicklist(t, ql, nil)
+	if _, ok := ql.Pop(QUICKLIST_TAIL); ok || ql.head != nil || ql.tail != nil {
+		t.Fatal("pop from an empty quicklist")
+	}
+}
+
+func TestQuicklistSizeLimit(t *testing.T) {
+	ql := QuicklistCreate(-1, 0) // 每个节点最多4k
+	val := strings.Repeat("v", 500)
+	for i := 0; i < 40; i++ {
+		ql.Push(val, QUICKLIST_TAIL)
+	}
+	for node := ql.head; node != nil; node = node.next {
+		if node.sz > optimizationLevel[0] {
+			t.Fatalf("node is %d bytes, limit is %d", node.sz, optimizationLevel[0])
+		}
+	}
+	if ql.len < 40*500/optimizationLevel[0] {
+		t.Fatalf("only %d nodes for %d bytes", ql.len, 40*500)
+	}
+}
+
+func TestQuicklistCompress(t *testing.T) {
+	ql := QuicklistCreate(8, 1)
+	var want []string
+	for i := 0; i < 100; i++ {
+		v := strings.Repeat(strconv.Itoa(i%10), 30)
+		ql.Push(v, QUICKLIST_TAIL)
+		want = append(want, v)
+	}
+	checkCompressed := func() {
+		t.Helper()
+		if ql.head.lp == nil || ql.tail.lp == nil {
+			t.Fatal("head or tail node is compressed")
+		}
+		for node := ql.head.next; node != ql.tail; node = node.next {
+			if node.lp != nil || node.compressed == nil {
+				t.Fatal("inner node is not compressed")
+			}
+		}
+	}
+	checkCompressed()
+	checkQuicklist(t, ql, want) // Range临时解压，用完要压回去
+	checkCompressed()
+	for i := 0; i < 30; i++ {
+		ql.Pop(QUICKLIST_HEAD)
+		ql.Pop(QUICKLIST_TAIL)
+	}
+	checkQuicklist(t, ql, want[30:70])
+	checkCompressed()
+}
+
+func TestQuicklistRecompressAfterChange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func() string {
+		b := make([]byte, 20)
+		r.Read(b)
+		return string(b)
+	}
+	ql := QuicklistCreate(4, 1)
+	for i := 0; i < 4; i++ {
+		ql.Push(random(), QUICKLIST_TAIL)
+	}
+	node := ql.tail
+	ql.Push("h", QUICKLIST_HEAD)
+	ql.Push("t", QUICKLIST_TAIL) // node到了中间，随机数据压不小
+	if node.lp == nil || !node.attempted {
+		t.Fatal("incompressible node was compressed")
+	}
+	ql.Pop(QUICKLIST_TAIL) // node又到了尾部
+	ql.Pop(QUICKLIST_TAIL)
+	ql.Push(strings.Repeat("a", 1000), QUICKLIST_TAIL)
+	if node != ql.tail || node.attempted {
+		t.Fatal("modified node still marked as incompressible")
+	}
+	ql.Push("t", QUICKLIST_TAIL)
+	if node.lp != nil {
+		t.Fatal("node was not compressed after it became compressible")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"go-redis/list"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+回复的编码
+命令处理函数不要自己拼协议，用这里的函数，RESP2和RESP3的差别在这里处理
+1. null：RESP2是 $-1 或 *-1，RESP3统一是 _
+2. map：RESP2是两倍长度的数组，RESP3是 %
+3. set：RESP2是数组，RESP3是 ~
+4. double：RESP2是bulk字符串，RESP3是 ,
+5. bool：RESP2是整数1/0，RESP3是 #t/#f
+6. 大整数和带格式的文本：RESP2是bulk字符串，RESP3是 ( 和 =
+7. push：RESP2是数组，RESP3是 >，订阅的消息和失效通知用
+*/
+
+const ERRORSTATS_LIMIT int = 128 // 最多记多少种错误码
+
+// 回复链表，每个节点是一块缓冲区，len是用了多少，cap是这块的大小
+type (
+	ReplyList  = list.List[[]byte]
+	ReplyBlock = list.Node[[]byte]
+)
+
+// 连接使用的协议版本
+const (
+	RESP2 int = 2
+	RESP3 int = 3
+)
+
+// 状态回复 +OK
+func (c *GodisClient) AddReplyStatus(status string) {
+	c.AddReplyStr("+" + status + "\r\n")
+}
+
+/*
+错误回复
+1. 没有以'-'开头的话就加上 -ERR，错误信息里的换行会破坏协议，换成空格
+2. 按错误码(第一个单词)计数，给 INFO errorstats 用
+*/
+func (c *GodisClient) AddReplyError(err string) {
+	if !strings.HasPrefix(err, "-") {
+		err = "-ERR " + err
+	}
+	err = strings.NewReplacer("\r", " ", "\n", " ").Replace(err)
+	c.AddReplyStr(err + "\r\n")
+	incrementErrorCount(err[1:])
+}
+
+/*
+错误码的种类太多了(比如脚本里随便返回的错误)就不再记新的，免得map一直涨
+*/
+func incrementErrorCount(err string) {
+	server.statTotalErrorReplies++
+	code := err
+	if i := strings.IndexByte(err, ' '); i >= 0 {
+		code = err[:i]
+	}
+	if _, ok := server.errorReplies[code]; !ok && len(server.errorReplies) >= ERRORSTATS_LIMIT {
+		return
+	}
+	server.errorReplies[code]++
+}
+
+func (c *GodisClient) AddReplyErrorFormat(format string, a ...interface{}) {
+	c.AddReplyError(fmt.Sprintf(format, a...))
+}
+
+// 子命令不认识或者参数个数不对
+func (c *GodisClient) AddReplySubcommandSyntaxError() {
+	c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+}
+
+func (c *GodisClient) AddReplyInt(n int64) {
+	c.AddReplyStr(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *GodisClient) AddReplyBulkString(s string) {
+	c.AddReplyStr("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+// 对象按字符串回复，整数编码的也一样
+func (c *GodisClient) AddReplyBulk(o *Gobj) {
+	c.AddReplyBulkString(o.StrVal())
+}
+
+// 不存在的值
+func (c *GodisClient) AddReplyNull() {
+	if c.resp == RESP2 {
+		c.AddReplyStr("$-1\r\n")
+	} else {
+		c.AddReplyStr("_\r\n")
+	}
+}
+
+// 不存在的数组，比如超时的阻塞命令和被打断的事务
+func (c *GodisClient) AddReplyNullArray() {
+	if c.resp == RESP2 {
+		c.AddReplyStr("*-1\r\n")
+	} else {
+		c.AddReplyStr("_\r\n")
+	}
+}
+
+func (c *GodisClient) AddReplyArrayLen(length int) {
+	c.AddReplyStr("*" + strconv.Itoa(length) + "\r\n")
+}
+
+// length是键值对的个数
+func (c *GodisClient) AddReplyMapLen(length int) {
+	if c.resp == RESP2 {
+		c.AddReplyArrayLen(length * 2)
+	} else {
+		c.AddReplyStr("%" + strconv.Itoa(length) + "\r\n")
+	}
+}
+
+func (c *GodisClient) AddReplySetLen(length int) {
+	if c.resp == RESP2 {
+		c.AddReplyArrayLen(length)
+	} else {
+		c.AddReplyStr("~" + strconv.Itoa(length) + "\r\n")
+	}
+}
+
+// 浮点数用最短的能还原回来的写法，无穷大写成inf/-inf
+func formatDouble(d float64) string {
+	if math.IsInf(d, 1) {
+		return "inf"
+	} else if math.IsInf(d, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(d, 'g', -1, 64)
+}
+
+func (c *GodisClient) AddReplyDouble(d float64) {
+	if c.resp == RESP2 {
+		c.AddReplyBulkString(formatDouble(d))
+	} else {
+		c.AddReplyStr("," + formatDouble(d) + "\r\n")
+	}
+}
+
+func (c *GodisClient) AddReplyBool(b bool) {
+	if c.resp == RESP2 {
+		if b {
+			c.AddReplyInt(1)
+		} else {
+			c.AddReplyInt(0)
+		}
+	} else if b {
+		c.AddReplyStr("#t\r\n")
+	} else {
+		c.AddReplyStr("#f\r\n")
+	}
+}
+
+// 超过int64范围的整数，num必须是合法的十进制整数
+func (c *GodisClient) AddReplyBigNum(num string) {
+	if c.resp == RESP2 {
+		c.AddReplyBulkString(num)
+	} else {
+		c.AddReplyStr("(" + num + "\r\n")
+	}
+}
+
+/*
+带格式的文本，ext是三个字符的格式，比如txt、mkd
+客户端可以原样显示，不用转义换行
+*/
+func (c *GodisClient) AddReplyVerbatim(s, ext string) {
+	if c.resp == RESP2 {
+		c.AddReplyBulkString(s)
+	} else {
+		c.AddReplyStr("=" + strconv.Itoa(len(s)+4) + "\r\n" + ext + ":" + s + "\r\n")
+	}
+}
+
+// 附加信息，后面跟着length个键值对，再后面才是真正的回复，RESP2没有这个类型，调用前要检查协议版本
+func (c *GodisClient) AddReplyAttributeLen(length int) {
+	c.AddReplyStr("|" + strconv.Itoa(length) + "\r\n")
+}
+
+// 服务器主动推送的消息
+func (c *GodisClient) AddReplyPushLen(length int) {
+	if c.resp == RESP2 {
+		c.AddReplyArrayLen(length)
+	} else {
+		c.AddReplyStr(">" + strconv.Itoa(length) + "\r\n")
+	}
+}
+
+// HELP子命令的回复，每一行是一个状态回复
+func (c *GodisClient) AddReplyHelp(help []string) {
+	c.AddReplyArrayLen(len(help))
+	for _, line := range help {
+		c.AddReplyStatus(line)
+	}
+}
+
+/*
+先占个位置，等元素都放进去了再回填长度
+1. 占位的是链表里一个空节点，后面的回复都只能接在链表里，排在它后面
+2. 回填之前这个节点不能发出去，命令执行完之前一定要调用SetDeferred*Len
+*/
+func (c *GodisClient) AddReplyDeferredLen() *ReplyBlock {
+	c.prepareClientToWrite()
+	c.reply.Append(nil)
+	return c.reply.Last()
+}
+
+func (c *GodisClient) setDeferredReply(node *ReplyBlock, s string) {
+	releaseReplyBlock(node.Val)
+	node.Val = dupReplyBlock([]byte(s))
+}
+
+func (c *GodisClient) SetDeferredArrayLen(node *ReplyBlock, length int) {
+	c.setDeferredReply(node, "*"+strconv.Itoa(length)+"\r\n")
+}
+
+func (c *GodisClient) SetDeferredMapLen(node *ReplyBlock, length int) {
+	if c.resp == RESP2 {
+		c.SetDeferredArrayLen(node, length*2)
+	} else {
+		c.setDeferredReply(node, "%"+strconv.Itoa(length)+"\r\n")
+	}
+}
+
+func (c *GodisClient) SetDeferredSetLen(node *ReplyBlock, length int) {
+	if c.resp == RESP2 {
+		c.SetDeferredArrayLen(node, length)
+	} else {
+		c.setDeferredReply(node, "~"+strconv.Itoa(length)+"\r\n")
+	}
+}
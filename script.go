@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/*
+脚本 EVAL/EVALSHA/SCRIPT
+用gopher-lua做脚本引擎，脚本通过 redis.call/redis.pcall 调用命令
+
+脚本跑在一个单独的goroutine里，但是它调用的命令会通过 luaCallCh 交给事件循环所在的goroutine执行，
+所以server的状态永远只在一个goroutine里被修改。EVAL会一直等到脚本结束，其它客户端的命令插不进来，保证了原子性。
+脚本跑得太久(超过lua-time-limit)，就开始处理其它客户端的请求，只允许 SCRIPT KILL，其它的都回复BUSY。
+*/
+
+// 脚本调用命令的请求
+type luaCallRequest struct {
+	args  []string
+	reply chan string
+}
+
+type luaState struct {
+	L          *lua.LState
+	scripts    map[string]*lua.LFunction // sha1 -> 编译好的脚本
+	client     *GodisClient              // 执行脚本里命令的伪客户端
+	caller     *GodisClient              // 正在执行脚本的客户端
+	callCh     chan *luaCallRequest
+	cancel     context.CancelFunc
+	timeLimit  int64 // 超过多少毫秒算是繁忙
+	timedOut   bool  // 已经超时了，其它客户端会收到BUSY
+	killed     bool  // 被 SCRIPT KILL 了
+	writeDirty bool  // 脚本执行过写命令，不能被杀掉
+}
+
+/*
+初始化脚本环境
+1. 只打开base/table/string/math这几个库，不让脚本碰文件
+2. 注册redis表
+3. 创建执行命令用的伪客户端
+*/
+func scriptingInit(timeLimit int64) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetField(redis, "call", L.NewFunction(luaRedisCallCommand))
+	L.SetField(redis, "pcall", L.NewFunction(luaRedisPCallCommand))
+	L.SetField(redis, "sha1hex", L.NewFunction(luaRedisSha1hexCommand))
+	L.SetField(redis, "error_reply", L.NewFunction(luaRedisErrorReplyCommand))
+	L.SetField(redis, "status_reply", L.NewFunction(luaRedisStatusReplyCommand))
+	L.SetGlobal("redis", redis)
+
+	client := CreateClient(-1)
+	client.flags |= CLIENT_SCRIPT | CLIENT_DENY_BLOCKING
+
+	server.lua = &luaState{
+		L:         L,
+		scripts:   make(map[string]*lua.LFunction),
+		client:    client,
+		callCh:    make(chan *luaCallRequest),
+		timeLimit: timeLimit,
+	}
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+编译脚本并放到缓存里，返回sha1
+编译失败的话回复错误
+*/
+func luaCreateFunction(c *GodisClient, body string) (string, bool) {
+	sha := sha1hex(body)
+	if _, ok := server.lua.scripts[sha]; ok {
+		return sha, true
+	}
+	fn, err := server.lua.L.Load(strings.NewReader(body), "@user_script")
+	if err != nil {
+		c.AddReplyErrorFormat("Error compiling script (new function): %s", oneLine(err.Error()))
+		return "", false
+	}
+	server.lua.scripts[sha] = fn
+	return sha, true
+}
+
+// 错误回复里不能有换行
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+/*
+lua的参数转成命令的参数，只能是字符串和数字
+*/
+func luaArgsToStrings(L *lua.LState) ([]string, bool) {
+	argc := L.GetTop()
+	if argc == 0 {
+		return nil, false
+	}
+	args := make([]string, argc)
+	for i := 1; i <= argc; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(v)
+		case lua.LNumber:
+			args[i-1] = luaNumberToString(v)
+		default:
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+func luaNumberToString(n lua.LNumber) string {
+	f := float64(n)
+	if f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+/*
+redis.call 和 redis.pcall 的实现，跑在脚本的goroutine里
+1. 把参数交给事件循环的goroutine执行，等它返回协议格式的回复
+2. 回复转成lua的值
+3. call遇到错误回复直接抛出，pcall把错误当成返回值
+*/
+func luaRedisGenericCommand(L *lua.LState, raiseError bool) int {
+	args, ok := luaArgsToStrings(L)
+	if !ok {
+		errTable := luaErrorTable(L, "ERR Lua redis lib command arguments must be strings or integers")
+		if raiseError {
+			L.Error(errTable, 1)
+		}
+		L.Push(errTable)
+		return 1
+	}
+	req := &luaCallRequest{args: args, reply: make(chan string, 1)}
+	server.lua.callCh <- req
+	reply := <-req.reply
+	val, _ := luaReplyToLuaType(L, reply)
+	if tbl, ok := val.(*lua.LTable); ok && raiseError && tbl.RawGetString("err") != lua.LNil {
+		L.Error(tbl, 1)
+	}
+	L.Push(val)
+	return 1
+}
+
+func luaRedisCallCommand(L *lua.LState) int {
+	return luaRedisGenericCommand(L, true)
+}
+
+func luaRedisPCallCommand(L *lua.LState) int {
+	return luaRedisGenericCommand(L, false)
+}
+
+func luaRedisSha1hexCommand(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("wrong number of arguments")
+	}
+	L.Push(lua.LString(sha1hex(L.ToString(1))))
+	return 1
+}
+
+func luaErrorTable(L *lua.LState, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(msg))
+	return t
+}
+
+func luaRedisErrorReplyCommand(L *lua.LState) int {
+	L.Push(luaErrorTable(L, L.CheckString(1)))
+	return 1
+}
+
+func luaRedisStatusReplyCommand(L *lua.LState) int {
+	t := L.NewTable()
+	t.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(t)
+	return 1
+}
+
+/*
+协议格式的回复转成lua的值，返回值和用掉的字节数
++OK -> {ok="OK"}
+-ERR -> {err="ERR"}
+:1 -> 1
+$-1 / *-1 -> false
+*/
+func luaReplyToLuaType(L *lua.LState, reply string) (lua.LValue, int) {
+	end := strings.Index(reply, "\r\n")
+	if end < 0 {
+		return lua.LFalse, len(reply)
+	}
+	line := reply[1:end]
+	pos := end + 2
+	switch reply[0] {
+	case '+':
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(line))
+		return t, pos
+	case '-':
+		return luaErrorTable(L, line), pos
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), pos
+	case '$':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, pos
+		}
+		return lua.LString(reply[pos : pos+n]), pos + n + 2
+	case '*':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, pos
+		}
+		t := L.NewTable()
+		for i := 1; i <= n; i++ {
+			val, used := luaReplyToLuaType(L, reply[pos:])
+			t.RawSetInt(i, val)
+			pos += used
+		}
+		return t, pos
+	}
+	return lua.LFalse, len(reply)
+}
+
+/*
+脚本的返回值转成回复
+数字 -> 整数，字符串 -> bulk，true -> 1，false/nil -> 空
+{err=...} -> 错误，{ok=...} -> 状态，其它的table按数组处理，遇到nil就停
+*/
+func luaReplyToRedisReply(c *GodisClient, val lua.LValue) {
+	switch v := val.(type) {
+	case lua.LString:
+		c.AddReplyBulkString(string(v))
+	case lua.LNumber:
+		c.AddReplyInt(int64(v))
+	case lua.LBool:
+		if v {
+			c.AddReplyInt(1)
+		} else {
+			c.AddReplyNull()
+		}
+	case *lua.LTable:
+		if errVal, ok := v.RawGetString("err").(lua.LString); ok {
+			c.AddReplyError("-" + oneLine(string(errVal)))
+			return
+		}
+		if okVal, ok := v.RawGetString("ok").(lua.LString); ok {
+			c.AddReplyStatus(oneLine(string(okVal)))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		c.AddReplyArrayLen(n)
+		for i := 1; i <= n; i++ {
+			luaReplyToRedisReply(c, v.RawGetInt(i))
+		}
+	default:
+		c.AddReplyNull()
+	}
+}
+
+/*
+在事件循环的goroutine里执行脚本调用的命令，返回协议格式的回复
+*/
+func luaExecCommand(args []string) string {
+	c := server.lua.client
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		return "-ERR Unknown Redis command called from script\r\n"
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		return "-ERR Wrong number of args calling Redis command from script\r\n"
+	}
+	if cmd.flags&CMD_NOSCRIPT != 0 {
+		return "-ERR This Redis command is not allowed from script\r\n"
+	}
+	if server.maxmemory > 0 && cmd.flags&CMD_DENYOOM != 0 && server.preCommandOOMState {
+		return OOM_ERR + "\r\n"
+	}
+	if cmd.flags&CMD_WRITE != 0 {
+		server.lua.writeDirty = true
+	}
+	c.args = make([]*Gobj, len(args))
+	for i, arg := range args {
+		c.args[i] = CreateObject(GSTR, arg)
+	}
+	c.cmd = cmd
+	call(c)
+	resetClient(c)
+
+	var sb strings.Builder
+	sb.Write(c.buf[:c.bufpos])
+	for n := c.reply.First(); n != nil; n = n.Next() {
+		sb.Write(n.Val)
+	}
+	freeReplyList(c)
+	return sb.String()
+}
+
+/*
+脚本跑太久了，把调用者的读事件摘掉，不然它的下一条命令会在脚本还没结束的时候被执行
+*/
+func protectClient(c *GodisClient) {
+	server.keLoop.RemoveFileEvent(c.fd, KE_READABLE)
+}
+
+func unprotectClient(c *GodisClient) {
+	if server.clients[c.fd] == c {
+		server.keLoop.AddFileEvent(c.fd, KE_READABLE, ReadQueryFromClient, c)
+	}
+}
+
+/*
+执行脚本
+1. 设置KEYS和ARGV
+2. 在新的goroutine里跑脚本，当前goroutine负责执行脚本调用的命令
+3. 超过时间限制后，一边等脚本一边处理其它客户端的请求
+4. 脚本结束，把返回值转成回复
+*/
+func evalGenericCommand(c *GodisClient, sha string) {
+	lst := server.lua
+	numkeys, ok := getLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	if numkeys > int64(len(c.args)-3) {
+		c.AddReplyError("Number of keys can't be greater than number of args")
+		return
+	}
+	if numkeys < 0 {
+		c.AddReplyError("Number of keys can't be negative")
+		return
+	}
+	fn := lst.scripts[sha]
+	L := lst.L
+	keys, argv := L.NewTable(), L.NewTable()
+	for i, arg := range c.args[3 : 3+numkeys] {
+		keys.RawSetInt(i+1, lua.LString(arg.StrVal()))
+	}
+	for i, arg := range c.args[3+numkeys:] {
+		argv.RawSetInt(i+1, lua.LString(arg.StrVal()))
+	}
+	L.SetGlobal("KEYS", keys)
+	L.SetGlobal("ARGV", argv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+	lst.cancel = cancel
+	lst.caller = c
+	lst.killed = false
+	lst.writeDirty = false
+	done := make(chan error, 1)
+	go func() {
+		L.Push(fn)
+		done <- L.PCall(0, 1, nil)
+	}()
+
+	var err error
+	deadline := time.After(time.Duration(lst.timeLimit) * time.Millisecond)
+wait:
+	for {
+		if !lst.timedOut {
+			select {
+			case req := <-lst.callCh:
+				req.reply <- luaExecCommand(req.args)
+			case err = <-done:
+				break wait
+			case <-deadline:
+				log.Printf("slow script detected: still in execution after %v milliseconds\n", lst.timeLimit)
+				lst.timedOut = true
+				protectClient(c)
+			}
+		} else {
+			select {
+			case req := <-lst.callCh:
+				req.reply <- luaExecCommand(req.args)
+			case err = <-done:
+				break wait
+			default:
+				server.keLoop.ProcessFileEvents(10)
+				handleClientsWithPendingWrites()
+			}
+		}
+	}
+	cancel()
+	L.RemoveContext()
+	if lst.timedOut {
+		lst.timedOut = false
+		unprotectClient(c)
+	}
+	lst.caller = nil
+	lst.cancel = nil
+
+	if err != nil {
+		if lst.killed {
+			c.AddReplyError("Error running script (call to f_" + sha + "): @user_script: Script killed by user with SCRIPT KILL...")
+		} else if apiErr, ok := err.(*lua.ApiError); ok {
+			if tbl, ok := apiErr.Object.(*lua.LTable); ok && tbl.RawGetString("err") != lua.LNil {
+				luaReplyToRedisReply(c, tbl) // redis.call 抛出来的错误，原样返回
+			} else {
+				c.AddReplyErrorFormat("Error running script (call to f_%s): %s", sha, oneLine(apiErr.Object.String()))
+			}
+		} else {
+			c.AddReplyErrorFormat("Error running script (call to f_%s): %s", sha, oneLine(err.Error()))
+		}
+		L.SetTop(0)
+		return
+	}
+	ret := L.Get(-1)
+	L.SetTop(0)
+	luaReplyToRedisReply(c, ret)
+}
+
+/*
+EVAL script numkeys [key ...] [arg ...]
+*/
+func evalCommand(c *GodisClient) {
+	sha, ok := luaCreateFunction(c, c.args[1].StrVal())
+	if !ok {
+		return
+	}
+	evalGenericCommand(c, sha)
+}
+
+/*
+EVALSHA sha1 numkeys [key ...] [arg ...]
+*/
+func evalShaCommand(c *GodisClient) {
+	sha := strings.ToLower(c.args[1].StrVal())
+	if _, ok := server.lua.scripts[sha]; !ok {
+		c.AddReplyError("-NOSCRIPT No matching script. Please use EVAL.")
+		return
+	}
+	evalGenericCommand(c, sha)
+}
+
+/*
+SCRIPT LOAD/EXISTS/FLUSH/KILL
+*/
+func scriptCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "load" && len(c.args) == 3:
+		sha, ok := luaCreateFunction(c, c.args[2].StrVal())
+		if !ok {
+			return
+		}
+		c.AddReplyBulkString(sha)
+	case sub == "exists" && len(c.args) >= 3:
+		c.AddReplyArrayLen(len(c.args) - 2)
+		for _, arg := range c.args[2:] {
+			if _, ok := server.lua.scripts[strings.ToLower(arg.StrVal())]; ok {
+				c.AddReplyInt(1)
+			} else {
+				c.AddReplyInt(0)
+			}
+		}
+	case sub == "flush" && len(c.args) <= 3:
+		if len(c.args) == 3 {
+			mode := strings.ToLower(c.args[2].StrVal())
+			if mode != "sync" && mode != "async" {
+				c.AddReplyError("SCRIPT FLUSH only support SYNC|ASYNC option")
+				return
+			}
+		}
+		server.lua.scripts = make(map[string]*lua.LFunction)
+		c.AddReplyStatus("OK")
+	case sub == "kill" && len(c.args) == 2:
+		if server.lua.caller == nil {
+			c.AddReplyError("-NOTBUSY No scripts in execution right now.")
+		} else if server.lua.writeDirty {
+			c.AddReplyError("-UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+				"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+		} else {
+			server.lua.killed = true
+			server.lua.cancel()
+			c.AddReplyStatus("OK")
+		}
+	default:
+		c.AddReplySubcommandSyntaxError()
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+列表类型的命令
+元素少的时候Val是一个*Listpack，超过一个quicklist节点的大小之后转成*Quicklist
+列表变得足够小的时候再转回listpack
+元素都是按字符串拷贝进去的，不再引用参数对象
+*/
+
+const (
+	LIST_HEAD int = QUICKLIST_HEAD
+	LIST_TAIL int = QUICKLIST_TAIL
+)
+
+func listTypeCreate() *Gobj {
+	return CreateObject(GLIST, lpNew())
+}
+
+/*
+listpack再放进去一个元素就超过一个节点的限制了，转成quicklist
+原来的listpack直接当成quicklist的第一个节点
+*/
+func listTypeTryConvertListpack(lobj *Gobj, val string) {
+	lp := lobj.Val.(*Listpack)
+	if !quicklistNodeExceedsLimit(server.listMaxListpackSize, lp.Bytes()+len(val)+11, lp.Length()+1) {
+		return
+	}
+	ql := QuicklistCreate(server.listMaxListpackSize, server.listCompressDepth)
+	if lp.Length() > 0 {
+		zmalloc(QUICKLIST_NODE_SIZE)
+		node := &quicklistNode{lp: lp, sz: lp.Bytes(), count: lp.Length()}
+		ql.insertNode(node, QUICKLIST_TAIL)
+		ql.count = int64(node.count)
+	} else {
+		zfree(int64(lp.Bytes()))
+	}
+	zmalloc(QUICKLIST_SIZE - LISTPACK_SIZE) // dict里记的是转换前对象的大小
+	lobj.Val = ql
+	lobj.encoding = OBJ_ENCODING_QUICKLIST
+}
+
+/*
+quicklist只剩一个节点，并且不到限制的一半了，转回listpack
+留一半的余量，免得在边界上来回转换
+*/
+func listTypeTryConvertQuicklist(lobj *Gobj) {
+	ql := lobj.Val.(*Quicklist)
+	if ql.len > 1 {
+		return
+	}
+	var lp *Listpack
+	if ql.len == 1 {
+		node := ql.head
+		if quicklistNodeExceedsLimit(server.listMaxListpackSize, node.sz*2, node.count*2) {
+			return
+		}
+		node.decompress()
+		lp = node.lp
+		zfree(QUICKLIST_NODE_SIZE)
+	} else {
+		lp = lpNew()
+	}
+	zfree(QUICKLIST_SIZE - LISTPACK_SIZE)
+	lobj.Val = lp
+	lobj.encoding = OBJ_ENCODING_LISTPACK
+}
+
+func listTypePush(lobj *Gobj, val *Gobj, where int) {
+	str := val.StrVal()
+	if lobj.encoding == OBJ_ENCODING_LISTPACK {
+		listTypeTryConvertListpack(lobj, str)
+	}
+	if lobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := lobj.Val.(*Listpack)
+		if where == LIST_HEAD {
+			lp.Prepend(str)
+		} else {
+			lp.Append(str)
+		}
+		return
+	}
+	lobj.Val.(*Quicklist).Push(str, where)
+}
+
+// 弹出的对象由调用方负责减引用计数
+func listTypePop(lobj *Gobj, where int) *Gobj {
+	var str string
+	if lobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := lobj.Val.(*Listpack)
+		p := lp.First()
+		if where == LIST_TAIL {
+			p = lp.Last()
+		}
+		if p == -1 {
+			return nil
+		}
+		str = lp.Get(p)
+		lp.Delete(p)
+	} else {
+		var ok bool
+		if str, ok = lobj.Val.(*Quicklist).Pop(where); !ok {
+			return nil
+		}
+		listTypeTryConvertQuicklist(lobj)
+	}
+	return CreateObject(GSTR, str)
+}
+
+func listTypeLength(lobj *Gobj) int64 {
+	if lobj.encoding == OBJ_ENCODING_LISTPACK {
+		return int64(lobj.Val.(*Listpack).Length())
+	}
+	return lobj.Val.(*Quicklist).Count()
+}
+
+// 从下标start开始依次访问n个元素
+func listTypeRange(lobj *Gobj, start, n int64, fn func(val string)) {
+	if lobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := lobj.Val.(*Listpack)
+		for p := lp.Seek(int(start)); p != -1 && n > 0; p = lp.Next(p) {
+			fn(lp.Get(p))
+			n--
+		}
+		return
+	}
+	lobj.Val.(*Quicklist).Range(start, n, fn)
+}
+
+// 解析 LEFT|RIGHT
+func getListPositionFromObjectOrReply(c *GodisClient, o *Gobj) (int, bool) {
+	switch strings.ToLower(o.StrVal()) {
+	case "left":
+		return LIST_HEAD, true
+	case "right":
+		return LIST_TAIL, true
+	}
+	c.AddReplyError("syntax error")
+	return 0, false
+}
+
+func listEventName(where int, push bool) string {
+	if push {
+		if where == LIST_HEAD {
+			return "lpush"
+		}
+		return "rpush"
+	}
+	if where == LIST_HEAD {
+		return "lpop"
+	}
+	return "rpop"
+}
+
+// 列表弹空了就把key删掉
+func listDeleteIfEmpty(key, lobj *Gobj) {
+	if listTypeLength(lobj) == 0 {
+		dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, 0)
+	}
+}
+
+/*
+LPUSH/RPUSH key element [element ...]
+key不存在就新建一个列表
+*/
+func pushGenericCommand(c *GodisClient, where int) {
+	key := c.args[1]
+	lobj := findKeyWrite(key)
+	if lobj != nil && lobj.Type != GLIST {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	if lobj == nil {
+		lobj = listTypeCreate()
+		server.db.data.Set(key, lobj)
+		lobj.DecrRefCount()
+	}
+	for _, val := range c.args[2:] {
+		listTypePush(lobj, val, where)
+	}
+	c.AddReplyInt(listTypeLength(lobj))
+	signalModifiedKey(key)
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, true), key, 0)
+	signalKeyAsReady(key)
+}
+
+func lpushCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_HEAD)
+}
+
+func rpushCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_TAIL)
+}
+
+/*
+LPOP/RPOP key [count]
+不带count回复一个元素，带count回复数组
+*/
+func popGenericCommand(c *GodisClient, where int) {
+	if len(c.args) > 3 {
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+	var count int64 = -1
+	if len(c.args) == 3 {
+		var ok bool
+		if count, ok = getLongFromObjectOrReply(c, c.args[2], "value is out of range, must be positive"); !ok {
+			return
+		}
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+	}
+	key := c.args[1]
+	lobj := findKeyWrite(key)
+	if lobj == nil {
+		if count == -1 {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyNullArray()
+		}
+		return
+	}
+	if lobj.Type != GLIST {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	if count == 0 { // 什么都没弹出来，不算修改
+		c.AddReplyArrayLen(0)
+		return
+	}
+	if count == -1 {
+		val := listTypePop(lobj, where)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+	} else {
+		listPopRangeAndReply(c, lobj, where, count)
+	}
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, false), key, 0)
+	listDeleteIfEmpty(key, lobj)
+	signalModifiedKey(key)
+}
+
+// 弹出最多count个元素，以数组的形式回复
+func listPopRangeAndReply(c *GodisClient, lobj *Gobj, where int, count int64) {
+	if length := listTypeLength(lobj); count > length {
+		count = length
+	}
+	c.AddReplyArrayLen(int(count))
+	for i := int64(0); i < count; i++ {
+		val := listTypePop(lobj, where)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+	}
+}
+
+func lpopCommand(c *GodisClient) {
+	popGenericCommand(c, LIST_HEAD)
+}
+
+func rpopCommand(c *GodisClient) {
+	popGenericCommand(c, LIST_TAIL)
+}
+
+func llenCommand(c *GodisClient) {
+	lobj := findKeyRead(c.args[1])
+	if lobj == nil {
+		c.AddReplyInt(0)
+		return
+	}
+	if lobj.Type != GLIST {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	c.AddReplyInt(listTypeLength(lobj))
+}
+
+/*
+LRANGE key start stop
+负数下标从后往前数
+*/
+func lrangeCommand(c *GodisClient) {
+	start, ok := getLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	lobj := findKeyRead(c.args[1])
+	if lobj == nil {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	if lobj.Type != GLIST {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	length := listTypeLength(lobj)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= length {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	if end >= length {
+		end = length - 1
+	}
+	c.AddReplyArrayLen(int(end - start + 1))
+	listTypeRange(lobj, start, end-start+1, func(val string) {
+		c.AddReplyBulkString(val)
+	})
+}
+
+/*
+把弹出来的元素放到目标列表里，目标不存在就新建
+*/
+func lmoveHandlePush(dstkey *Gobj, dstobj *Gobj, val *Gobj, where int) {
+	if dstobj == nil {
+		dstobj = listTypeCreate()
+		server.db.data.Set(dstkey, dstobj)
+		dstobj.DecrRefCount()
+	}
+	listTypePush(dstobj, val, where)
+	signalModifiedKey(dstkey)
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, true), dstkey, 0)
+	signalKeyAsReady(dstkey)
+}
+
+/*
+从src弹出一个元素放到dst，回复这个元素
+src不存在返回false，什么都不回复
+*/
+func lmoveGenericCommand(c *GodisClient, wherefrom, whereto int) bool {
+	srckey, dstkey := c.args[1], c.args[2]
+	sobj := findKeyWrite(srckey)
+	if sobj == nil {
+		return false
+	}
+	if sobj.Type != GLIST {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return true
+	}
+	dobj := findKeyWrite(dstkey)
+	if dobj != nil && dobj.Type != GLIST {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return true
+	}
+	val := listTypePop(sobj, wherefrom)
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName(wherefrom, false), srckey, 0)
+	lmoveHandlePush(dstkey, dobj, val, whereto)
+	c.AddReplyBulk(val)
+	val.DecrRefCount()
+	listDeleteIfEmpty(srckey, sobj)
+	signalModifiedKey(srckey)
+	return true
+}
+
+/*
+LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+*/
+func lmoveCommand(c *GodisClient) {
+	wherefrom, ok := getListPositionFromObjectOrReply(c, c.args[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(c, c.args[4])
+	if !ok {
+		return
+	}
+	if !lmoveGenericCommand(c, wherefrom, whereto) {
+		c.AddReplyNull()
+	}
+}
+
+/*
+解析 numkeys key [key ...] LEFT|RIGHT [COUNT count] 这种格式，LMPOP和ZMPOP都用
+pos是numkeys的位置，where用parseWhere解析
+*/
+func parseMPopArgsOrReply(c *GodisClient, pos int, parseWhere func(c *GodisClient, o *Gobj) (int, bool)) (keys []*Gobj, where int, count int64, ok bool) {
+	numkeys, ok := getLongFromObjectOrReply(c, c.args[pos], "numkeys should be greater than 0")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		c.AddReplyError("numkeys should be greater than 0")
+		return nil, 0, 0, false
+	}
+	wherePos := pos + 1 + int(numkeys)
+	if wherePos >= len(c.args) {
+		c.AddReplyError("syntax error")
+		return nil, 0, 0, false
+	}
+	keys = c.args[pos+1 : wherePos]
+	if where, ok = parseWhere(c, c.args[wherePos]); !ok {
+		return
+	}
+	count = 1
+	countGiven := false
+	for i := wherePos + 1; i < len(c.args); i++ {
+		if strings.ToLower(c.args[i].StrVal()) == "count" && i+1 < len(c.args) && !countGiven {
+			i++
+			if count, ok = getLongFromObjectOrReply(c, c.args[i], "count should be greater than 0"); !ok {
+				return
+			}
+			if count <= 0 {
+				c.AddReplyError("count should be greater than 0")
+				return nil, 0, 0, false
+			}
+			countGiven = true
+		} else {
+			c.AddReplyError("syntax error")
+			return nil, 0, 0, false
+		}
+	}
+	return keys, where, count, true
+}
+
+/*
+从第一个非空的列表里弹出最多count个元素
+回复 [key, [element ...]]，都是空的返回false
+*/
+func lmpopGenericCommand(c *GodisClient, keys []*Gobj, where int, count int64) bool {
+	for _, key := range keys {
+		lobj := findKeyWrite(key)
+		if lobj == nil {
+			continue
+		}
+		if lobj.Type != GLIST {
+			c.AddReplyError(WRONGTYPE_ERR)
+			return true
+		}
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		listPopRangeAndReply(c, lobj, where, count)
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, false), key, 0)
+		listDeleteIfEmpty(key, lobj)
+		signalModifiedKey(key)
+		return true
+	}
+	return false
+}
+
+/*
+LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+*/
+func lmpopCommand(c *GodisClient) {
+	keys, where, count, ok := parseMPopArgsOrReply(c, 1, getListPositionFromObjectOrReply)
+	if !ok {
+		return
+	}
+	if !lmpopGenericCommand(c, keys, where, count) {
+		c.AddReplyNullArray()
+	}
+}
+
+/*
+BLPOP/BRPOP key [key ...] timeout
+1. 有一个key不空，就和LPOP一样，回复 [key, element]
+2. 都是空的，事务里直接回复空，否则阻塞
+*/
+func blockingPopGenericCommand(c *GodisClient, where int) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	for _, key := range keys {
+		lobj := findKeyWrite(key)
+		if lobj == nil {
+			continue
+		}
+		if lobj.Type != GLIST {
+			c.AddReplyError(WRONGTYPE_ERR)
+			return
+		}
+		val := listTypePop(lobj, where)
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, false), key, 0)
+		listDeleteIfEmpty(key, lobj)
+		signalModifiedKey(key)
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bpop.where = where
+	c.bpop.count = -1
+	blockForKeys(c, BLOCKED_LIST, keys, timeout)
+}
+
+func blpopCommand(c *GodisClient) {
+	blockingPopGenericCommand(c, LIST_HEAD)
+}
+
+func brpopCommand(c *GodisClient) {
+	blockingPopGenericCommand(c, LIST_TAIL)
+}
+
+/*
+BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+*/
+func blmoveCommand(c *GodisClient) {
+	wherefrom, ok := getListPositionFromObjectOrReply(c, c.args[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(c, c.args[4])
+	if !ok {
+		return
+	}
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[5])
+	if !ok {
+		return
+	}
+	if lmoveGenericCommand(c, wherefrom, whereto) {
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bpop.where = wherefrom
+	c.bpop.whereto = whereto
+	c.bpop.count = -1
+	c.bpop.target = c.args[2]
+	c.bpop.target.IncrRefCount()
+	blockForKeys(c, BLOCKED_LIST, c.args[1:2], timeout)
+}
+
+/*
+BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+*/
+func blmpopCommand(c *GodisClient) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[1])
+	if !ok {
+		return
+	}
+	keys, where, count, ok := parseMPopArgsOrReply(c, 2, getListPositionFromObjectOrReply)
+	if !ok {
+		return
+	}
+	if lmpopGenericCommand(c, keys, where, count) {
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bpop.where = where
+	c.bpop.count = count
+	blockForKeys(c, BLOCKED_LIST, keys, timeout)
+}
+
+/*
+服务一个阻塞在列表上的客户端，调用方保证key是非空的列表
+1. BLMOVE: 弹出来放到目标列表，目标类型不对的话回复错误
+2. BLMPOP: 弹出最多count个
+3. BLPOP/BRPOP: 弹出一个
+*/
+func serveClientBlockedOnList(c *GodisClient, key, lobj *Gobj) {
+	where := c.bpop.where
+	if c.bpop.target != nil {
+		dstkey := c.bpop.target
+		dobj := findKeyWrite(dstkey)
+		if dobj != nil && dobj.Type != GLIST {
+			c.AddReplyError(WRONGTYPE_ERR)
+			unblockClient(c)
+			return
+		}
+		val := listTypePop(lobj, where)
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, false), key, 0)
+		lmoveHandlePush(dstkey, dobj, val, c.bpop.whereto)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+	} else if c.bpop.count >= 0 {
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		listPopRangeAndReply(c, lobj, where, c.bpop.count)
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, false), key, 0)
+	} else {
+		val := listTypePop(lobj, where)
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName(where, false), key, 0)
+	}
+	listDeleteIfEmpty(key, lobj)
+	signalModifiedKey(key)
+	unblockClient(c)
+}
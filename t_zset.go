@@ -0,0 +1,585 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+有序集合类型的命令
+元素少的时候Val是*Listpack，member和score挨着存，按score排好序
+元素多了或者member太长，转成*ZSet(跳表+字典)
+*/
+
+const (
+	ZSET_MIN int = 0
+	ZSET_MAX int = 1
+)
+
+const (
+	ZADD_NX int = 1 << 0 // 只添加新元素
+	ZADD_XX int = 1 << 1 // 只更新已有的元素
+	ZADD_CH int = 1 << 2 // 返回变化了的元素个数
+	ZADD_GT int = 1 << 3 // 新分数更大才更新
+	ZADD_LT int = 1 << 4 // 新分数更小才更新
+)
+
+func zsetTypeCreate() *Gobj {
+	if server.zsetMaxListpackEntries == 0 {
+		return CreateObject(GZSET, ZSetCreate())
+	}
+	return CreateObject(GZSET, lpNew())
+}
+
+/*
+listpack编码的有序集合
+*/
+func zzlGetScore(lp *Listpack, p int) float64 {
+	str, ival, isInt := lp.GetValue(p)
+	if isInt {
+		return float64(ival)
+	}
+	score, _ := strconv.ParseFloat(str, 64)
+	return score
+}
+
+// 找到member的位置，没有返回-1
+func zzlFind(lp *Listpack, ele string) (int, float64) {
+	for p := lp.First(); p != -1; p = lp.Next(lp.Next(p)) {
+		if lp.Get(p) == ele {
+			return p, zzlGetScore(lp, lp.Next(p))
+		}
+	}
+	return -1, 0
+}
+
+// 按score排序插入，调用方保证ele不存在
+func zzlInsert(lp *Listpack, ele string, score float64) {
+	p := lp.First()
+	for ; p != -1; p = lp.Next(lp.Next(p)) {
+		s := zzlGetScore(lp, lp.Next(p))
+		if s > score || (s == score && lp.Get(p) > ele) {
+			break
+		}
+	}
+	p = lp.Insert(p, ele, LP_BEFORE)
+	lp.Insert(p, formatDouble(score), LP_AFTER)
+}
+
+func zzlDelete(lp *Listpack, p int) {
+	p = lp.Delete(p)
+	lp.Delete(p)
+}
+
+/*
+listpack转成跳表
+对象的大小变了，dict里记的是转换前的大小，这里补上差值
+*/
+func zsetConvert(zobj *Gobj) {
+	lp := zobj.Val.(*Listpack)
+	zs := ZSetCreate()
+	for p := lp.First(); p != -1; p = lp.Next(lp.Next(p)) {
+		zs.Add(zzlGetScore(lp, lp.Next(p)), lp.Get(p))
+	}
+	zfree(int64(lp.Bytes()))
+	zmalloc(ZSET_SIZE - LISTPACK_SIZE)
+	zobj.Val = zs
+	zobj.encoding = OBJ_ENCODING_SKIPLIST
+}
+
+func zsetLength(zobj *Gobj) int64 {
+	if zobj.encoding == OBJ_ENCODING_LISTPACK {
+		return int64(zobj.Val.(*Listpack).Length() / 2)
+	}
+	return zobj.Val.(*ZSet).Length()
+}
+
+func zsetScore(zobj *Gobj, ele string) (float64, bool) {
+	if zobj.encoding == OBJ_ENCODING_LISTPACK {
+		p, score := zzlFind(zobj.Val.(*Listpack), ele)
+		return score, p != -1
+	}
+	return zobj.Val.(*ZSet).Score(ele)
+}
+
+/*
+添加或者更新一个元素，返回是不是新添加的
+元素个数或者member长度超过了 zset-max-listpack-entries/zset-max-listpack-value 就转成跳表
+*/
+func zsetAdd(zobj *Gobj, score float64, ele string) bool {
+	if zobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := zobj.Val.(*Listpack)
+		if p, old := zzlFind(lp, ele); p != -1 {
+			if old != score {
+				zzlDelete(lp, p)
+				zzlInsert(lp, ele, score)
+			}
+			return false
+		}
+		if zsetLength(zobj)+1 <= int64(server.zsetMaxListpackEntries) && len(ele) <= server.zsetMaxListpackValue {
+			zzlInsert(lp, ele, score)
+			return true
+		}
+		zsetConvert(zobj)
+	}
+	return zobj.Val.(*ZSet).Add(score, ele)
+}
+
+func zsetRemove(zobj *Gobj, ele string) bool {
+	if zobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := zobj.Val.(*Listpack)
+		p, _ := zzlFind(lp, ele)
+		if p == -1 {
+			return false
+		}
+		zzlDelete(lp, p)
+		return true
+	}
+	return zobj.Val.(*ZSet).Remove(ele)
+}
+
+// 分数最小(大)的元素，调用方保证非空
+func zsetFirstOrLast(zobj *Gobj, where int) (string, float64) {
+	if zobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := zobj.Val.(*Listpack)
+		if where == ZSET_MIN {
+			p := lp.First()
+			return lp.Get(p), zzlGetScore(lp, lp.Next(p))
+		}
+		p := lp.Last()
+		return lp.Get(lp.Prev(p)), zzlGetScore(lp, p)
+	}
+	var x *zskiplistNode
+	if where == ZSET_MIN {
+		x = zobj.Val.(*ZSet).First()
+	} else {
+		x = zobj.Val.(*ZSet).Last()
+	}
+	return x.ele, x.score
+}
+
+// 从排名start(从0开始)开始，依次访问n个元素
+func zsetRangeByRank(zobj *Gobj, start, n int64, fn func(ele string, score float64)) {
+	if zobj.encoding == OBJ_ENCODING_LISTPACK {
+		lp := zobj.Val.(*Listpack)
+		for p := lp.Seek(int(start * 2)); n > 0; n-- {
+			sp := lp.Next(p)
+			fn(lp.Get(p), zzlGetScore(lp, sp))
+			p = lp.Next(sp)
+		}
+		return
+	}
+	x := zobj.Val.(*ZSet).zsl.GetElementByRank(start + 1)
+	for ; n > 0; n-- {
+		fn(x.ele, x.score)
+		x = x.level[0].forward
+	}
+}
+
+// 解析 MIN|MAX
+func getZsetPositionFromObjectOrReply(c *GodisClient, o *Gobj) (int, bool) {
+	switch strings.ToLower(o.StrVal()) {
+	case "min":
+		return ZSET_MIN, true
+	case "max":
+		return ZSET_MAX, true
+	}
+	c.AddReplyError("syntax error")
+	return 0, false
+}
+
+func zsetEventName(where int) string {
+	if where == ZSET_MIN {
+		return "zpopmin"
+	}
+	return "zpopmax"
+}
+
+func zsetDeleteIfEmpty(key, zobj *Gobj) {
+	if zsetLength(zobj) == 0 {
+		dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, 0)
+	}
+}
+
+/*
+ZADD key [NX|XX] [GT|LT] [CH] score member [score member ...]
+*/
+func zaddCommand(c *GodisClient) {
+	flags := 0
+	i := 2
+	for ; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "nx" {
+			flags |= ZADD_NX
+		} else if opt == "xx" {
+			flags |= ZADD_XX
+		} else if opt == "ch" {
+			flags |= ZADD_CH
+		} else if opt == "gt" {
+			flags |= ZADD_GT
+		} else if opt == "lt" {
+			flags |= ZADD_LT
+		} else {
+			break
+		}
+	}
+	elements := len(c.args) - i
+	if elements == 0 || elements%2 != 0 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	if flags&ZADD_NX != 0 && flags&ZADD_XX != 0 {
+		c.AddReplyError("XX and NX options at the same time are not compatible")
+		return
+	}
+	if (flags&ZADD_GT != 0 && flags&ZADD_NX != 0) || (flags&ZADD_LT != 0 && flags&ZADD_NX != 0) ||
+		(flags&ZADD_GT != 0 && flags&ZADD_LT != 0) {
+		c.AddReplyError("GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	// 先把分数都解析好，有一个不对整个命令都不执行
+	scores := make([]float64, 0, elements/2)
+	for j := i; j < len(c.args); j += 2 {
+		score, ok := getFloatFromObjectOrReply(c, c.args[j], "")
+		if !ok {
+			return
+		}
+		scores = append(scores, score)
+	}
+
+	key := c.args[1]
+	zobj := findKeyWrite(key)
+	if zobj != nil && zobj.Type != GZSET {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	if zobj == nil {
+		if flags&ZADD_XX != 0 {
+			c.AddReplyInt(0)
+			return
+		}
+		zobj = zsetTypeCreate()
+		server.db.data.Set(key, zobj)
+		zobj.DecrRefCount()
+	}
+	added, updated := 0, 0
+	for j, score := range scores {
+		ele := c.args[i+j*2+1].StrVal()
+		old, exists := zsetScore(zobj, ele)
+		if exists {
+			if flags&ZADD_NX != 0 || old == score ||
+				(flags&ZADD_GT != 0 && score <= old) || (flags&ZADD_LT != 0 && score >= old) {
+				continue
+			}
+			zsetAdd(zobj, score, ele)
+			updated++
+		} else if flags&ZADD_XX == 0 {
+			zsetAdd(zobj, score, ele)
+			added++
+		}
+	}
+	if flags&ZADD_CH != 0 {
+		c.AddReplyInt(int64(added + updated))
+	} else {
+		c.AddReplyInt(int64(added))
+	}
+	if added+updated > 0 {
+		signalModifiedKey(key)
+		notifyKeyspaceEvent(NOTIFY_ZSET, "zadd", key, 0)
+		signalKeyAsReady(key)
+	}
+}
+
+func zremCommand(c *GodisClient) {
+	key := c.args[1]
+	zobj := findKeyWrite(key)
+	if zobj == nil {
+		c.AddReplyInt(0)
+		return
+	}
+	if zobj.Type != GZSET {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	deleted := 0
+	for _, ele := range c.args[2:] {
+		if zsetRemove(zobj, ele.StrVal()) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		notifyKeyspaceEvent(NOTIFY_ZSET, "zrem", key, 0)
+		zsetDeleteIfEmpty(key, zobj)
+		signalModifiedKey(key)
+	}
+	c.AddReplyInt(int64(deleted))
+}
+
+func zcardCommand(c *GodisClient) {
+	zobj := findKeyRead(c.args[1])
+	if zobj == nil {
+		c.AddReplyInt(0)
+		return
+	}
+	if zobj.Type != GZSET {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	c.AddReplyInt(zsetLength(zobj))
+}
+
+func zscoreCommand(c *GodisClient) {
+	zobj := findKeyRead(c.args[1])
+	if zobj == nil {
+		c.AddReplyNull()
+		return
+	}
+	if zobj.Type != GZSET {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	score, ok := zsetScore(zobj, c.args[2].StrVal())
+	if !ok {
+		c.AddReplyNull()
+		return
+	}
+	c.AddReplyDouble(score)
+}
+
+/*
+ZRANGE key start stop [WITHSCORES]
+按排名取，负数从后往前数
+*/
+func zrangeCommand(c *GodisClient) {
+	withScores := false
+	if len(c.args) == 5 && strings.ToLower(c.args[4].StrVal()) == "withscores" {
+		withScores = true
+	} else if len(c.args) != 4 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	start, ok := getLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	zobj := findKeyRead(c.args[1])
+	if zobj == nil {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	if zobj.Type != GZSET {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	length := zsetLength(zobj)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= length {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	if end >= length {
+		end = length - 1
+	}
+	// RESP3下带分数的时候每个元素是一个 [member, score] 数组，RESP2下平铺
+	n := end - start + 1
+	if withScores && c.resp == RESP2 {
+		c.AddReplyArrayLen(int(n * 2))
+	} else {
+		c.AddReplyArrayLen(int(n))
+	}
+	zsetRangeByRank(zobj, start, n, func(ele string, score float64) {
+		if withScores && c.resp == RESP3 {
+			c.AddReplyArrayLen(2)
+		}
+		c.AddReplyBulkString(ele)
+		if withScores {
+			c.AddReplyDouble(score)
+		}
+	})
+}
+
+/*
+从有序集合里弹出最多count个分数最小(大)的元素
+withKey: 回复 [key, member, score] 这种平铺的格式(BZPOPMIN)
+mpop: 回复 [key, [[member, score] ...]] 这种格式(ZMPOP)
+都不是的话回复 [member, score, ...] (ZPOPMIN)
+*/
+func genericZpopAndReply(c *GodisClient, key, zobj *Gobj, where int, count int64, withKey, mpop bool) {
+	if length := zsetLength(zobj); count > length {
+		count = length
+	}
+	if mpop {
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyArrayLen(int(count))
+	} else if withKey {
+		c.AddReplyArrayLen(int(count*2 + 1))
+		c.AddReplyBulk(key)
+	} else {
+		c.AddReplyArrayLen(int(count * 2))
+	}
+	for i := int64(0); i < count; i++ {
+		ele, score := zsetFirstOrLast(zobj, where)
+		zsetRemove(zobj, ele)
+		if mpop {
+			c.AddReplyArrayLen(2)
+		}
+		c.AddReplyBulkString(ele)
+		c.AddReplyDouble(score)
+	}
+	if count > 0 {
+		notifyKeyspaceEvent(NOTIFY_ZSET, zsetEventName(where), key, 0)
+		zsetDeleteIfEmpty(key, zobj)
+		signalModifiedKey(key)
+	}
+}
+
+/*
+ZPOPMIN/ZPOPMAX key [count]
+*/
+func zpopGenericCommand(c *GodisClient, where int) {
+	if len(c.args) > 3 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	var count int64 = 1
+	if len(c.args) == 3 {
+		var ok bool
+		if count, ok = getLongFromObjectOrReply(c, c.args[2], "value is out of range, must be positive"); !ok {
+			return
+		}
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+	}
+	key := c.args[1]
+	zobj := findKeyWrite(key)
+	if zobj == nil {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	if zobj.Type != GZSET {
+		c.AddReplyError(WRONGTYPE_ERR)
+		return
+	}
+	genericZpopAndReply(c, key, zobj, where, count, false, false)
+}
+
+func zpopminCommand(c *GodisClient) {
+	zpopGenericCommand(c, ZSET_MIN)
+}
+
+func zpopmaxCommand(c *GodisClient) {
+	zpopGenericCommand(c, ZSET_MAX)
+}
+
+/*
+从第一个非空的有序集合里弹出，都是空的返回false
+*/
+func zmpopGenericCommand(c *GodisClient, keys []*Gobj, where int, count int64, mpop bool) bool {
+	for _, key := range keys {
+		zobj := findKeyWrite(key)
+		if zobj == nil {
+			continue
+		}
+		if zobj.Type != GZSET {
+			c.AddReplyError(WRONGTYPE_ERR)
+			return true
+		}
+		genericZpopAndReply(c, key, zobj, where, count, !mpop, mpop)
+		return true
+	}
+	return false
+}
+
+/*
+ZMPOP numkeys key [key ...] MIN|MAX [COUNT count]
+*/
+func zmpopCommand(c *GodisClient) {
+	keys, where, count, ok := parseMPopArgsOrReply(c, 1, getZsetPositionFromObjectOrReply)
+	if !ok {
+		return
+	}
+	if !zmpopGenericCommand(c, keys, where, count, true) {
+		c.AddReplyNullArray()
+	}
+}
+
+/*
+BZPOPMIN/BZPOPMAX key [key ...] timeout
+*/
+func bzpopGenericCommand(c *GodisClient, where int) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	if zmpopGenericCommand(c, keys, where, 1, false) {
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bpop.where = where
+	c.bpop.count = -1
+	blockForKeys(c, BLOCKED_ZSET, keys, timeout)
+}
+
+func bzpopminCommand(c *GodisClient) {
+	bzpopGenericCommand(c, ZSET_MIN)
+}
+
+func bzpopmaxCommand(c *GodisClient) {
+	bzpopGenericCommand(c, ZSET_MAX)
+}
+
+/*
+BZMPOP timeout numkeys key [key ...] MIN|MAX [COUNT count]
+*/
+func bzmpopCommand(c *GodisClient) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[1])
+	if !ok {
+		return
+	}
+	keys, where, count, ok := parseMPopArgsOrReply(c, 2, getZsetPositionFromObjectOrReply)
+	if !ok {
+		return
+	}
+	if zmpopGenericCommand(c, keys, where, count, true) {
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bpop.where = where
+	c.bpop.count = count
+	blockForKeys(c, BLOCKED_ZSET, keys, timeout)
+}
+
+/*
+服务一个阻塞在有序集合上的客户端，调用方保证key是非空的有序集合
+*/
+func serveClientBlockedOnZset(c *GodisClient, key, zobj *Gobj) {
+	if c.bpop.count >= 0 {
+		genericZpopAndReply(c, key, zobj, c.bpop.where, c.bpop.count, false, true)
+	} else {
+		genericZpopAndReply(c, key, zobj, c.bpop.where, 1, true, false)
+	}
+	unblockClient(c)
+}
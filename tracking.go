@@ -0,0 +1,317 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+客户端缓存追踪 (CLIENT TRACKING)
+默认模式: 记住每个客户端读过哪些key, server.trackingTable 保存 key -> 客户端id
+广播模式: 不记key，客户端订阅前缀，server.prefixTable 保存 前缀 -> 客户端
+key被修改、过期或者淘汰的时候，给对应的客户端发失效消息
+
+RESP2下，失效消息只能通过 REDIRECT 转发给一个订阅了 __redis__:invalidate 的客户端
+*/
+
+const TRACKING_CHANNEL = "__redis__:invalidate"
+
+/*
+开启追踪
+1. 设置标志位
+2. 广播模式下，把客户端注册到每一个前缀下面，没有前缀就是空前缀，匹配所有key
+*/
+func enableTracking(c *GodisClient, redirect int64, options int, prefixes []string) {
+	c.flags |= CLIENT_TRACKING
+	c.flags &^= CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_NOLOOP
+	c.flags |= options & (CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_NOLOOP)
+	c.trackingRedirect = redirect
+
+	if options&CLIENT_TRACKING_BCAST != 0 {
+		if len(prefixes) == 0 {
+			prefixes = []string{""}
+		}
+		if c.trackingPrefixes == nil {
+			c.trackingPrefixes = make(map[string]struct{})
+		}
+		for _, prefix := range prefixes {
+			clients := server.prefixTable[prefix]
+			if clients == nil {
+				clients = make(map[int64]*GodisClient)
+				server.prefixTable[prefix] = clients
+			}
+			clients[c.id] = c
+			c.trackingPrefixes[prefix] = struct{}{}
+		}
+	}
+}
+
+/*
+关闭追踪
+trackingTable 里残留的id不用管，发失效消息的时候会跳过没开追踪的客户端
+*/
+func disableTracking(c *GodisClient) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		return
+	}
+	for prefix := range c.trackingPrefixes {
+		clients := server.prefixTable[prefix]
+		delete(clients, c.id)
+		if len(clients) == 0 {
+			delete(server.prefixTable, prefix)
+		}
+	}
+	c.trackingPrefixes = nil
+	c.trackingRedirect = 0
+	c.flags &^= CLIENT_TRACKING | CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN |
+		CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_CACHING | CLIENT_TRACKING_NOLOOP
+}
+
+/*
+检查前缀有没有重叠，同一个客户端的两个前缀不能互为前缀
+有重叠的话回复错误，返回false
+*/
+func checkPrefixCollisionsOrReply(c *GodisClient, prefixes []string) bool {
+	for i, prefix := range prefixes {
+		for existing := range c.trackingPrefixes {
+			if strings.HasPrefix(existing, prefix) || strings.HasPrefix(prefix, existing) {
+				c.AddReplyErrorFormat("Prefix '%s' overlaps with an existing prefix '%s'. "+
+					"Prefixes for a single client must not overlap.", prefix, existing)
+				return false
+			}
+		}
+		for j := i + 1; j < len(prefixes); j++ {
+			if strings.HasPrefix(prefixes[j], prefix) || strings.HasPrefix(prefix, prefixes[j]) {
+				c.AddReplyErrorFormat("Prefix '%s' overlaps with another provided prefix '%s'. "+
+					"Prefixes for a single client must not overlap.", prefix, prefixes[j])
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+记住客户端读过的key
+OPTIN模式下只有 CLIENT CACHING yes 之后的命令才记
+OPTOUT模式下 CLIENT CACHING no 之后的命令不记
+*/
+func trackingRememberKeys(c *GodisClient) {
+	optin := c.flags&CLIENT_TRACKING_OPTIN != 0
+	optout := c.flags&CLIENT_TRACKING_OPTOUT != 0
+	caching := c.flags&CLIENT_TRACKING_CACHING != 0
+	if (optin && !caching) || (optout && caching) {
+		return
+	}
+	for _, key := range getKeysFromCommand(c.cmd, c.args) {
+		ids := server.trackingTable[key.StrVal()]
+		if ids == nil {
+			ids = make(map[int64]struct{})
+			server.trackingTable[key.StrVal()] = ids
+		}
+		ids[c.id] = struct{}{}
+	}
+}
+
+/*
+给客户端发失效消息
+1. 如果设置了转发，就发给转发的客户端，转发的客户端不在了就告诉RESP3的客户端 tracking-redir-broken
+2. RESP3的客户端直接推送 invalidate 消息
+3. RESP2下只有转发到的、处于订阅模式的客户端能收到频道消息
+*/
+func sendTrackingMessage(c *GodisClient, key string) {
+	redirected := false
+	if c.trackingRedirect != 0 {
+		redir := lookupClientByID(c.trackingRedirect)
+		if redir == nil { // 转发的客户端已经断开了，RESP3的客户端要告诉它
+			if c.resp == RESP3 {
+				c.AddReplyPushLen(2)
+				c.AddReplyBulkString("tracking-redir-broken")
+				c.AddReplyInt(c.trackingRedirect)
+			}
+			return
+		}
+		c = redir
+		redirected = true
+	}
+	if c.resp == RESP3 {
+		c.AddReplyPushLen(2)
+		c.AddReplyBulkString("invalidate")
+	} else if redirected && c.flags&CLIENT_PUBSUB != 0 {
+		c.AddReplyPushLen(3)
+		c.AddReplyBulkString("message")
+		c.AddReplyBulkString(TRACKING_CHANNEL)
+	} else {
+		return
+	}
+	c.AddReplyArrayLen(1)
+	c.AddReplyBulkString(key)
+}
+
+/*
+广播模式，找到所有前缀匹配这个key的客户端
+*/
+func trackingBroadcastKey(key string) {
+	for prefix, clients := range server.prefixTable {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, c := range clients {
+			if c.flags&CLIENT_TRACKING_NOLOOP != 0 && c == server.currentClient {
+				continue
+			}
+			sendTrackingMessage(c, key)
+		}
+	}
+}
+
+/*
+key被修改了，通知所有缓存了这个key的客户端
+1. 先处理广播模式
+2. 再从trackingTable中找到读过这个key的客户端，通知完就把这个key删掉，客户端下次读的时候会重新记
+*/
+func trackingInvalidateKey(key *Gobj) {
+	keyStr := key.StrVal()
+	if len(server.prefixTable) > 0 {
+		trackingBroadcastKey(keyStr)
+	}
+	ids, ok := server.trackingTable[keyStr]
+	if !ok {
+		return
+	}
+	delete(server.trackingTable, keyStr)
+	for id := range ids {
+		c := lookupClientByID(id)
+		if c == nil || c.flags&CLIENT_TRACKING == 0 || c.flags&CLIENT_TRACKING_BCAST != 0 {
+			continue
+		}
+		if c.flags&CLIENT_TRACKING_NOLOOP != 0 && c == server.currentClient {
+			continue
+		}
+		sendTrackingMessage(c, keyStr)
+	}
+}
+
+/*
+CLIENT TRACKING on|off [REDIRECT id] [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+*/
+func clientTrackingCommand(c *GodisClient) {
+	var redirect int64
+	var options int
+	var prefixes []string
+	for i := 3; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		moreArgs := i+1 < len(c.args)
+		if opt == "redirect" && moreArgs {
+			i++
+			if redirect != 0 {
+				c.AddReplyError("A client can only redirect to a single other client")
+				return
+			}
+			redirect = c.args[i].IntVal()
+			if redirect == c.id {
+				c.AddReplyError("A client can not redirect to itself")
+				return
+			}
+			if lookupClientByID(redirect) == nil {
+				c.AddReplyError("The client ID you want redirect to does not exist")
+				return
+			}
+		} else if opt == "bcast" {
+			options |= CLIENT_TRACKING_BCAST
+		} else if opt == "optin" {
+			options |= CLIENT_TRACKING_OPTIN
+		} else if opt == "optout" {
+			options |= CLIENT_TRACKING_OPTOUT
+		} else if opt == "noloop" {
+			options |= CLIENT_TRACKING_NOLOOP
+		} else if opt == "prefix" && moreArgs {
+			i++
+			prefixes = append(prefixes, c.args[i].StrVal())
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+	}
+
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "on":
+		if options&CLIENT_TRACKING_BCAST == 0 && len(prefixes) > 0 {
+			c.AddReplyError("PREFIX option requires BCAST mode to be enabled")
+			return
+		}
+		if c.flags&CLIENT_TRACKING != 0 {
+			oldBcast := c.flags&CLIENT_TRACKING_BCAST != 0
+			newBcast := options&CLIENT_TRACKING_BCAST != 0
+			if oldBcast != newBcast {
+				c.AddReplyError("You can't switch BCAST mode on/off before disabling tracking " +
+					"for this client, and then re-enabling it with a different mode.")
+				return
+			}
+		}
+		if options&CLIENT_TRACKING_BCAST != 0 && options&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) != 0 {
+			c.AddReplyError("OPTIN and OPTOUT are not compatible with BCAST")
+			return
+		}
+		if options&CLIENT_TRACKING_OPTIN != 0 && options&CLIENT_TRACKING_OPTOUT != 0 {
+			c.AddReplyError("You can't use both OPTIN and OPTOUT")
+			return
+		}
+		if (options&CLIENT_TRACKING_OPTIN != 0 && c.flags&CLIENT_TRACKING_OPTOUT != 0) ||
+			(options&CLIENT_TRACKING_OPTOUT != 0 && c.flags&CLIENT_TRACKING_OPTIN != 0) {
+			c.AddReplyError("You can't switch OPTIN/OPTOUT mode before disabling tracking " +
+				"for this client, and then re-enabling it with a different mode.")
+			return
+		}
+		if options&CLIENT_TRACKING_BCAST != 0 && !checkPrefixCollisionsOrReply(c, prefixes) {
+			return
+		}
+		enableTracking(c, redirect, options, prefixes)
+	case "off":
+		disableTracking(c)
+	default:
+		c.AddReplyError("syntax error")
+		return
+	}
+	c.AddReplyStatus("OK")
+}
+
+/*
+CLIENT CACHING yes|no
+只对下一条命令生效
+*/
+func clientCachingCommand(c *GodisClient) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		c.AddReplyError("CLIENT CACHING can be called only when the client is in tracking mode " +
+			"with OPTIN or OPTOUT mode enabled")
+		return
+	}
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "yes":
+		if c.flags&CLIENT_TRACKING_OPTIN == 0 {
+			c.AddReplyError("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+			return
+		}
+	case "no":
+		if c.flags&CLIENT_TRACKING_OPTOUT == 0 {
+			c.AddReplyError("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+			return
+		}
+	default:
+		c.AddReplyError("syntax error")
+		return
+	}
+	c.flags |= CLIENT_TRACKING_CACHING
+	c.AddReplyStatus("OK")
+}
+
+/*
+CLIENT GETREDIR
+没开追踪返回-1，开了追踪但没有转发返回0
+*/
+func clientGetRedirCommand(c *GodisClient) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		c.AddReplyInt(-1)
+		return
+	}
+	c.AddReplyInt(c.trackingRedirect)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+glob风格的匹配，和redis的stringmatch一样
+支持 * ? [abc] [^a-z] 以及 \ 转义
+*/
+func stringMatch(pattern, str string, nocase bool) bool {
+	if nocase {
+		pattern = strings.ToLower(pattern)
+		str = strings.ToLower(str)
+	}
+	return stringMatchImpl(pattern, str)
+}
+
+func stringMatchImpl(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' { // 连续的*等于一个*
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if stringMatchImpl(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == str[0] {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) > 0 { // 跳过 ]
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+/*
+按redis-cli的规则把一行拆成参数，和redis的sdssplitargs一样
+1. 参数之间可以有任意多个空白
+2. 双引号里支持 \n \r \t \b \a \xHH，反斜杠后面跟别的字符就是这个字符本身
+3. 单引号里只有 \' 一种转义
+4. 引号没有配对，或者右引号后面紧跟着别的字符，都是错误
+*/
+func splitArgs(line []byte) ([]string, error) {
+	args := []string{}
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, nil
+		}
+		var current []byte
+		inq, insq, done := false, false, false
+		for !done {
+			if inq {
+				if p == len(line) {
+					return nil, errors.New("unbalanced quotes in request")
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' && isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					current = append(current, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					c := line[p]
+					switch c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					current = append(current, c)
+				} else if line[p] == '"' {
+					// 右引号后面必须是空白或者结束
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else if insq {
+				if p == len(line) {
+					return nil, errors.New("unbalanced quotes in request")
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if line[p] == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else if p == len(line) {
+				break
+			} else {
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, string(current))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"   \t ", []string{}},
+		{"set key value", []string{"set", "key", "value"}},
+		{"  set   key\tvalue  ", []string{"set", "key", "value"}},
+		{`set key "hello world"`, []string{"set", "key", "hello world"}},
+		{`set key ""`, []string{"set", "key", ""}},
+		{`"a\nb\r\t\b\a"`, []string{"a\nb\r\t\b\a"}},
+		{`"\x41\x7a\xff" "\xzz" "\"\\"`, []string{"Az\xff", "xzz", `"\`}},
+		{`'it\'s' '\n'`, []string{"it's", `\n`}},
+		{`'say "hi"' "say 'hi'"`, []string{`say "hi"`, "say 'hi'"}},
+	}
+	for _, tc := range cases {
+		got, err := splitArgs([]byte(tc.line))
+		if err != nil {
+			t.Errorf("%q: %v", tc.line, err)
+			continue
+		}
+		if len(got) != len(tc.want) || strings.Join(got, "\x00") != strings.Join(tc.want, "\x00") {
+			t.Errorf("%q = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestSplitArgsUnbalanced(t *testing.T) {
+	for _, line := range []string{
+		`"foo`,
+		`'foo`,
+		`"foo"bar`,
+		`'foo'bar`,
+		`set "a\"`,
+		`a"b`,
+	} {
+		if args, err := splitArgs([]byte(line)); err == nil {
+			t.Errorf("%q = %q, want an error", line, args)
+		}
+	}
+}
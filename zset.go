@@ -1 +1,240 @@
 package main
+
+import "math/rand"
+
+const (
+	ZSKIPLIST_MAXLEVEL int     = 32
+	ZSKIPLIST_P        float64 = 0.25
+)
+
+/*
+跳表，和redis的zskiplist一样
+按 score 从小到大排，score相同的按 ele 的字典序排
+每一层都记录了跨度span，用来算排名
+*/
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int64
+}
+
+type zskiplistNode struct {
+	ele      string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int64
+	level  int
+}
+
+/*
+有序集合
+dict 保存 member -> score，用来O(1)查分数
+zsl 用来按分数排序
+*/
+type ZSet struct {
+	dict map[string]float64
+	zsl  *zskiplist
+}
+
+func zslCreateNode(level int, score float64, ele string) *zskiplistNode {
+	return &zskiplistNode{
+		ele:   ele,
+		score: score,
+		level: make([]zskiplistLevel, level),
+	}
+}
+
+func zslCreate() *zskiplist {
+	return &zskiplist{
+		header: zslCreateNode(ZSKIPLIST_MAXLEVEL, 0, ""),
+		level:  1,
+	}
+}
+
+// 随机一个层数，层数越高概率越小
+func zslRandomLevel() int {
+	level := 1
+	for level < ZSKIPLIST_MAXLEVEL && rand.Float64() < ZSKIPLIST_P {
+		level++
+	}
+	return level
+}
+
+// 节点a是否排在(score, ele)前面
+func zslLess(n *zskiplistNode, score float64, ele string) bool {
+	return n.score < score || (n.score == score && n.ele < ele)
+}
+
+/*
+插入一个节点，调用方保证ele不存在
+1. 从最高层往下找，记录每一层插入位置的前一个节点update和它的排名rank
+2. 随机一个层数，比当前层数高的话，高出来的层前驱就是header
+3. 把新节点串到每一层里，顺便更新跨度
+4. 设置后退指针
+*/
+func (zsl *zskiplist) Insert(score float64, ele string) *zskiplistNode {
+	var update [ZSKIPLIST_MAXLEVEL]*zskiplistNode
+	var rank [ZSKIPLIST_MAXLEVEL]int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, ele) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+	x = zslCreateNode(level, score, ele)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+	for i := level; i < zsl.level; i++ { // 没有碰到的层，跨度加一
+		update[i].level[i].span++
+	}
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// 把节点x从跳表中摘掉，update是每一层的前驱
+func (zsl *zskiplist) deleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+/*
+删除节点，找不到返回false
+*/
+func (zsl *zskiplist) Delete(score float64, ele string) bool {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, ele) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.ele == ele {
+		zsl.deleteNode(x, update)
+		return true
+	}
+	return false
+}
+
+/*
+按排名拿节点，排名从1开始
+*/
+func (zsl *zskiplist) GetElementByRank(rank int64) *zskiplistNode {
+	var traversed int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+func ZSetCreate() *ZSet {
+	return &ZSet{
+		dict: make(map[string]float64),
+		zsl:  zslCreate(),
+	}
+}
+
+func (zs *ZSet) Length() int64 {
+	return zs.zsl.length
+}
+
+func (zs *ZSet) Score(ele string) (float64, bool) {
+	score, ok := zs.dict[ele]
+	return score, ok
+}
+
+/*
+添加或者更新一个元素
+返回是不是新添加的
+*/
+func (zs *ZSet) Add(score float64, ele string) bool {
+	old, ok := zs.dict[ele]
+	if ok {
+		if old != score {
+			zs.zsl.Delete(old, ele)
+			zs.zsl.Insert(score, ele)
+			zs.dict[ele] = score
+		}
+		return false
+	}
+	zs.zsl.Insert(score, ele)
+	zs.dict[ele] = score
+	zmalloc(zsetElementSize(ele))
+	return true
+}
+
+func (zs *ZSet) Remove(ele string) bool {
+	score, ok := zs.dict[ele]
+	if !ok {
+		return false
+	}
+	zs.zsl.Delete(score, ele)
+	delete(zs.dict, ele)
+	zfree(zsetElementSize(ele))
+	return true
+}
+
+// 分数最小的元素
+func (zs *ZSet) First() *zskiplistNode {
+	return zs.zsl.header.level[0].forward
+}
+
+// 分数最大的元素
+func (zs *ZSet) Last() *zskiplistNode {
+	return zs.zsl.tail
+}